@@ -0,0 +1,270 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mail.v2"
+)
+
+// Attachment is a file that is attached to an email message.
+type Attachment struct {
+	// Name of the file as presented to the recipient.
+	Filename string
+	// Media type of the file content. It is detected from the content if it
+	// is empty.
+	ContentType string
+	// File content.
+	Data []byte
+}
+
+// SendEmailWithAttachments sends a multipart/mixed email message with plain
+// text body and base64 encoded attachments.
+func (s Service) SendEmailWithAttachments(from string, to []string, subject string, body string, attachments []Attachment) error {
+	if !s.enabled() {
+		return s.disabledError()
+	}
+	m, err := s.newMessage(from, to, subject, nil)
+	if err != nil {
+		return err
+	}
+	b, err := s.setTextBody(m, body)
+	if err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		if err := attach(m, a); err != nil {
+			return err
+		}
+	}
+
+	return s.sendMessage(m, m, b)
+}
+
+// attach adds the attachment to the message with Content-Type and
+// Content-Disposition headers that are formatted with the file name
+// parameters.
+func attach(m *mail.Message, a Attachment) error {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = http.DetectContentType(a.Data)
+	}
+	data := a.Data
+	// Content is written by the copy function instead of a reader, so that
+	// the message can be written more than once.
+	return addAttachment(m, a.Filename, contentType, 0, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// addAttachment adds the file with content written by the copy function as
+// an attachment to the message. Size is added as the Content-Disposition
+// parameter if it is positive.
+func addAttachment(m *mail.Message, filename, contentType string, size int64, copy func(io.Writer) error) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("email: attachment %q: invalid content type %q: %v", filename, contentType, err)
+	}
+	disposition := make(map[string]string)
+	if filename != "" {
+		params["name"] = filename
+		disposition["filename"] = filename
+	}
+	if size > 0 {
+		disposition["size"] = strconv.FormatInt(size, 10)
+	}
+	m.AttachReader(filename, nil, mail.SetHeader(map[string][]string{
+		"Content-Type":        {mime.FormatMediaType(mediaType, params)},
+		"Content-Disposition": {mime.FormatMediaType("attachment", disposition)},
+	}), mail.SetCopyFunc(copy))
+	return nil
+}
+
+// ErrAttachmentReaderConsumed is returned when a message with AttachmentReader
+// which Reader does not implement io.Seeker is written more than once, for
+// example when sending is retried.
+var ErrAttachmentReaderConsumed = errors.New("email: attachment reader consumed")
+
+// AttachmentReader is a file that is attached to an email message with the
+// content read from Reader. The content is encoded while the message is sent
+// over SMTP or to the sendmail program, without buffering the whole file in
+// memory. The complete message is buffered if Service.VerifyMessages or
+// Service.Transport is set, or if the message is sent with EightBit encoding
+// to a server without 8BITMIME extension.
+type AttachmentReader struct {
+	// Name of the file as presented to the recipient.
+	Filename string
+	// Media type of the file content. It is derived from the Filename
+	// extension if it is empty, and it is application/octet-stream for
+	// unknown extensions.
+	ContentType string
+	// File content. If it implements io.Seeker, like *os.File, it is read
+	// from the start every time the message is written, so the message can
+	// be sent again.
+	Reader io.Reader
+	// Size of the file content in bytes, if it is known. If it is positive,
+	// it is added to Content-Disposition header and sending fails if the
+	// Reader provides a different number of bytes.
+	Size int64
+}
+
+// SendEmailWithAttachmentReaders sends a multipart/mixed email message with
+// plain text body and base64 encoded attachments that are read while the
+// message is sent.
+func (s Service) SendEmailWithAttachmentReaders(from string, to []string, subject string, body string, attachments []AttachmentReader) error {
+	if !s.enabled() {
+		return s.disabledError()
+	}
+	m, err := s.newMessage(from, to, subject, nil)
+	if err != nil {
+		return err
+	}
+	b, err := s.setTextBody(m, body)
+	if err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		if err := attachReader(m, a); err != nil {
+			return err
+		}
+	}
+
+	return s.sendMessage(m, m, b)
+}
+
+// attachReader adds the attachment with the content that is copied from its
+// reader.
+func attachReader(m *mail.Message, a AttachmentReader) error {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(a.Filename))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+	}
+	var read bool
+	return addAttachment(m, a.Filename, contentType, a.Size, func(w io.Writer) error {
+		if read {
+			s, ok := a.Reader.(io.Seeker)
+			if !ok {
+				return fmt.Errorf("%w: %q", ErrAttachmentReaderConsumed, a.Filename)
+			}
+			if _, err := s.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("email: attachment %q: %w", a.Filename, err)
+			}
+		}
+		read = true
+		n, err := io.Copy(w, a.Reader)
+		if err != nil {
+			return fmt.Errorf("email: attachment %q: %w", a.Filename, err)
+		}
+		if a.Size > 0 && n != a.Size {
+			return fmt.Errorf("email: attachment %q: read %v bytes, expected %v", a.Filename, n, a.Size)
+		}
+		return nil
+	})
+}
+
+// ErrInlineImageNotFound is returned when HTML body references an inline
+// image with a Content-ID that is not provided.
+var ErrInlineImageNotFound = errors.New("email: inline image not found")
+
+// InlineImage is an image that is embedded in an email message and
+// referenced from the HTML body with a cid URL, for example
+// <img src="cid:logo">.
+type InlineImage struct {
+	// Content-ID of the image, without angle brackets, that is referenced
+	// in the HTML body.
+	ContentID string
+	// Media type of the image. It is detected from the content if it is
+	// empty.
+	ContentType string
+	// Optional file name of the image, that is added to Content-Type and
+	// Content-Disposition headers and used by clients that save it.
+	Filename string
+	// Image content.
+	Data []byte
+}
+
+// SendHTMLEmailWithInlineImages sends an email message with HTML body and
+// images that it references by Content-ID. The message is sent as
+// multipart/related with the multipart/alternative body, as sent by
+// SendHTMLEmail, and the images. All cid URLs in the HTML body must reference
+// the provided images, otherwise ErrInlineImageNotFound is returned.
+func (s Service) SendHTMLEmailWithInlineImages(from string, to []string, subject string, htmlBody string, images []InlineImage) error {
+	if !s.enabled() {
+		return s.disabledError()
+	}
+	ids := make(map[string]struct{}, len(images))
+	for _, img := range images {
+		if img.ContentID == "" || strings.ContainsAny(img.ContentID, "<>\r\n") {
+			return fmt.Errorf("email: invalid inline image content id %q", img.ContentID)
+		}
+		ids[img.ContentID] = struct{}{}
+	}
+	for _, match := range cidRegexp.FindAllStringSubmatch(htmlBody, -1) {
+		if _, ok := ids[match[1]]; !ok {
+			return fmt.Errorf("%w: %q", ErrInlineImageNotFound, match[1])
+		}
+	}
+
+	m, err := s.newMessage(from, to, subject, nil)
+	if err != nil {
+		return err
+	}
+	b, err := s.setAlternative(m, HTMLToText(htmlBody), htmlBody)
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		if err := embed(m, img); err != nil {
+			return err
+		}
+	}
+
+	return s.sendMessage(m, m, b)
+}
+
+// cidRegexp matches cid URLs in HTML attribute values and CSS.
+var cidRegexp = regexp.MustCompile(`cid:([^"'\s)>]+)`)
+
+// embed adds the inline image to the message as a related part with
+// Content-ID header.
+func embed(m *mail.Message, img InlineImage) error {
+	contentType := img.ContentType
+	if contentType == "" {
+		contentType = http.DetectContentType(img.Data)
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("email: inline image %q: invalid content type %q: %v", img.ContentID, contentType, err)
+	}
+	disposition := make(map[string]string)
+	if img.Filename != "" {
+		params["name"] = img.Filename
+		disposition["filename"] = img.Filename
+	}
+	data := img.Data
+	m.EmbedReader(img.ContentID, nil, mail.SetHeader(map[string][]string{
+		"Content-Type":        {mime.FormatMediaType(mediaType, params)},
+		"Content-Disposition": {mime.FormatMediaType("inline", disposition)},
+		"Content-ID":          {"<" + img.ContentID + ">"},
+	}), mail.SetCopyFunc(func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}))
+	return nil
+}
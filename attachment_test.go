@@ -0,0 +1,376 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestServiceSendEmailWithAttachments(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0, 1, 2, 3}, 100)...)
+	attachments := []Attachment{
+		{
+			Filename:    "report.pdf",
+			ContentType: "application/pdf",
+			Data:        []byte("%PDF-1.4 report"),
+		},
+		{
+			Filename: "gopher.png",
+			Data:     png,
+		},
+		{
+			Filename: "Извештај \"final\".bin",
+			Data:     []byte{0x00, 0x01, 0x02, 0x03},
+		},
+	}
+
+	if err := service.SendEmailWithAttachments("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body", attachments); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	m := recorder.Message()
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parse content type: %s", err)
+	}
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("expected multipart/mixed media type, got %s", mediaType)
+	}
+
+	r := multipart.NewReader(strings.NewReader(m.Body), params["boundary"])
+	p, err := r.NextPart()
+	if err != nil {
+		t.Fatalf("body part: %s", err)
+	}
+	body, err := ioutil.ReadAll(p)
+	if err != nil {
+		t.Fatalf("body part: read: %s", err)
+	}
+	if string(body) != "test body" {
+		t.Errorf(`body part: expected "test body", got "%s"`, body)
+	}
+
+	for i, want := range []struct {
+		mediaType string
+		filename  string
+		data      []byte
+	}{
+		{mediaType: "application/pdf", filename: "report.pdf", data: attachments[0].Data},
+		{mediaType: "image/png", filename: "gopher.png", data: png},
+		{mediaType: "application/octet-stream", filename: "Извештај \"final\".bin", data: attachments[2].Data},
+	} {
+		p, err := r.NextRawPart()
+		if err != nil {
+			t.Fatalf("attachment %v: %s", i, err)
+		}
+		mediaType, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatalf("attachment %v: parse content type: %s", i, err)
+		}
+		if mediaType != want.mediaType {
+			t.Errorf("attachment %v: expected media type %s, got %s", i, want.mediaType, mediaType)
+		}
+		if params["name"] != want.filename {
+			t.Errorf("attachment %v: expected name %q, got %q", i, want.filename, params["name"])
+		}
+		disposition, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+		if err != nil {
+			t.Fatalf("attachment %v: parse content disposition: %s", i, err)
+		}
+		if disposition != "attachment" {
+			t.Errorf("attachment %v: expected attachment disposition, got %s", i, disposition)
+		}
+		if params["filename"] != want.filename {
+			t.Errorf("attachment %v: expected filename %q, got %q", i, want.filename, params["filename"])
+		}
+		if enc := p.Header.Get("Content-Transfer-Encoding"); enc != "base64" {
+			t.Errorf("attachment %v: expected base64 encoding, got %s", i, enc)
+		}
+		raw, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatalf("attachment %v: read: %s", i, err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\r\n") {
+			if len(line) > 76 {
+				t.Errorf("attachment %v: line length %v exceeds 76 characters", i, len(line))
+			}
+		}
+		data, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(raw)))
+		if err != nil {
+			t.Fatalf("attachment %v: decode: %s", i, err)
+		}
+		if !bytes.Equal(data, want.data) {
+			t.Errorf("attachment %v: expected data %q, got %q", i, want.data, data)
+		}
+	}
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Errorf("expected no more parts, got %v", err)
+	}
+}
+
+func TestServiceSendEmailWithAttachmentsInvalidContentType(t *testing.T) {
+	service := Service{
+		SMTPHost: "localhost",
+	}
+
+	err := service.SendEmailWithAttachments("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body", []Attachment{
+		{Filename: "report.pdf", ContentType: "application/pdf\r\nBcc: attacker@example.com"},
+	})
+	if err == nil {
+		t.Error("expected error for invalid content type")
+	}
+}
+
+func TestServiceSendHTMLEmailWithInlineImages(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0, 1, 2, 3}, 100)...)
+	html := `<p><img src="cid:logo" alt="GopherPit"></p><p>Hello, gopher!</p><p><img src="cid:banner"></p>`
+
+	if err := service.SendHTMLEmailWithInlineImages("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", html, []InlineImage{
+		{ContentID: "logo", Data: png},
+		{ContentID: "banner", Filename: "banner.png", Data: png},
+	}); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	m := recorder.Message()
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parse content type: %s", err)
+	}
+	if mediaType != "multipart/related" {
+		t.Fatalf("expected multipart/related media type, got %s", mediaType)
+	}
+
+	r := multipart.NewReader(strings.NewReader(m.Body), params["boundary"])
+	p, err := r.NextRawPart()
+	if err != nil {
+		t.Fatalf("body part: %s", err)
+	}
+	body, err := ioutil.ReadAll(p)
+	if err != nil {
+		t.Fatalf("body part: read: %s", err)
+	}
+	// Line endings of the quoted-printable text part are converted to CRLF
+	// in transmission.
+	checkAlternativeParts(t, &smtpMessage{
+		Header: map[string][]string{"Content-Type": {p.Header.Get("Content-Type")}},
+		Body:   string(body),
+	}, strings.ReplaceAll(HTMLToText(html), "\n", "\r\n"), html)
+
+	p, err = r.NextRawPart()
+	if err != nil {
+		t.Fatalf("image part: %s", err)
+	}
+	match := cidRegexp.FindStringSubmatch(html)
+	if got, want := p.Header.Get("Content-ID"), "<"+match[1]+">"; got != want {
+		t.Errorf("expected Content-ID %q, got %q", want, got)
+	}
+	if got := p.Header.Get("Content-Type"); got != "image/png" {
+		t.Errorf("expected media type image/png, got %s", got)
+	}
+	if got := p.Header.Get("Content-Disposition"); got != "inline" {
+		t.Errorf("expected inline disposition, got %s", got)
+	}
+	data, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+	if err != nil {
+		t.Fatalf("image part: decode: %s", err)
+	}
+	if !bytes.Equal(data, png) {
+		t.Errorf("image part: expected data %q, got %q", png, data)
+	}
+
+	p, err = r.NextRawPart()
+	if err != nil {
+		t.Fatalf("image part: %s", err)
+	}
+	if got, want := p.Header.Get("Content-ID"), "<banner>"; got != want {
+		t.Errorf("expected Content-ID %q, got %q", want, got)
+	}
+	if got, want := p.Header.Get("Content-Type"), `image/png; name=banner.png`; got != want {
+		t.Errorf("expected content type %q, got %q", want, got)
+	}
+	if got, want := p.Header.Get("Content-Disposition"), `inline; filename=banner.png`; got != want {
+		t.Errorf("expected disposition %q, got %q", want, got)
+	}
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Errorf("expected no more parts, got %v", err)
+	}
+}
+
+func TestServiceSendHTMLEmailWithInlineImagesNotFound(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	err = service.SendHTMLEmailWithInlineImages("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", `<img src='cid:banner'>`, []InlineImage{
+		{ContentID: "logo", Data: []byte("GIF89a")},
+	})
+	if !errors.Is(err, ErrInlineImageNotFound) {
+		t.Errorf("expected error %v, got %v", ErrInlineImageNotFound, err)
+	}
+	if recorder.Message() != nil {
+		t.Errorf("expected no message, but message %#v has been recorded", recorder.Message())
+	}
+}
+
+// onlyReader hides all methods of the reader except Read.
+type onlyReader struct {
+	io.Reader
+}
+
+func TestServiceSendEmailWithAttachmentReaders(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	data := bytes.Repeat([]byte("gopher\x00\x01"), 128*1024)
+	if err := service.SendEmailWithAttachmentReaders("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body", []AttachmentReader{
+		{
+			Filename: "backup.tar",
+			Reader:   onlyReader{bytes.NewReader(data)},
+			Size:     int64(len(data)),
+		},
+	}); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	m := recorder.Message()
+	_, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parse content type: %s", err)
+	}
+	r := multipart.NewReader(strings.NewReader(m.Body), params["boundary"])
+	if _, err := r.NextPart(); err != nil {
+		t.Fatalf("body part: %s", err)
+	}
+	p, err := r.NextRawPart()
+	if err != nil {
+		t.Fatalf("attachment: %s", err)
+	}
+	if got := p.Header.Get("Content-Type"); got != "application/x-tar; name=backup.tar" {
+		t.Errorf("attachment: unexpected content type %q", got)
+	}
+	if got, want := p.Header.Get("Content-Disposition"), "attachment; filename=backup.tar; size="+strconv.Itoa(len(data)); got != want {
+		t.Errorf("attachment: got content disposition %q, expected %q", got, want)
+	}
+	got, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+	if err != nil {
+		t.Fatalf("attachment: decode: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("attachment: got %v bytes of unexpected data", len(got))
+	}
+}
+
+func TestServiceSendEmailWithAttachmentReadersErrors(t *testing.T) {
+	from := "gopher@gopherpit.com"
+	to := []string{"support@gopherpit.com"}
+
+	t.Run("size", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: recorder.Port,
+		}
+
+		err = service.SendEmailWithAttachmentReaders(from, to, "test subject", "test body", []AttachmentReader{
+			{Filename: "report.pdf", Reader: strings.NewReader("%PDF-1.4 report"), Size: 1024},
+		})
+		if err == nil || !strings.Contains(err.Error(), "expected 1024") {
+			t.Errorf("expected size error, got %v", err)
+		}
+		if recorder.Message() != nil {
+			t.Errorf("expected no message, but message %#v has been recorded", recorder.Message())
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		for _, tc := range []struct {
+			name    string
+			reader  io.Reader
+			wantErr error
+		}{
+			{name: "seeker", reader: strings.NewReader("%PDF-1.4 report")},
+			{name: "consumed", reader: onlyReader{strings.NewReader("%PDF-1.4 report")}, wantErr: ErrAttachmentReaderConsumed},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				transport := &flakyTransport{}
+				service := Service{
+					Transport:     transport,
+					RetryAttempts: 1,
+				}
+
+				err := service.SendEmailWithAttachmentReaders(from, to, "test subject", "test body", []AttachmentReader{
+					{Filename: "report.pdf", Reader: tc.reader},
+				})
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("expected error %v, got %v", tc.wantErr, err)
+				}
+				if tc.wantErr == nil && len(transport.Messages()) != 1 {
+					t.Errorf("expected message to be sent on retry")
+				}
+			})
+		}
+	})
+}
+
+// flakyTransport rejects the first message with a temporary error.
+type flakyTransport struct {
+	MemoryTransport
+	failed bool
+}
+
+func (t *flakyTransport) Send(from string, to []string, msg []byte) error {
+	if !t.failed {
+		t.failed = true
+		return &SendError{Stage: StageData, Code: 451, Err: &SMTPError{Command: "DATA", Code: 451, Message: "Try again later"}}
+	}
+	return t.MemoryTransport.Send(from, to, msg)
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"mime"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"gopkg.in/mail.v2"
+)
+
+// SendAudit is a record of a message send attempt which holds the
+// information about recipients without the message content. It is passed
+// to Service.AfterSend function.
+type SendAudit struct {
+	// Value of Message-ID header, if it is set.
+	MessageID string
+	// Decoded value of Subject header.
+	Subject string
+	// Time when sending started.
+	Time time.Time
+	// Duration of sending, including retries and waiting for the send
+	// window.
+	Duration time.Duration
+	// Size of the sent message content in bytes, before line endings are
+	// normalized for transmission. It is smaller than the message size if
+	// sending failed while the content was transmitted.
+	Size int64
+	// Email addresses from To, Cc and Bcc headers, without display names.
+	To  []string
+	Cc  []string
+	Bcc []string
+	// Error returned by the send attempt. All recipients received the
+	// message if it is nil, as a message is sent to all of its recipients in
+	// a single SMTP transaction, or to none of them.
+	Err error
+}
+
+func newSendAudit(m *mail.Message, start time.Time, d time.Duration, size int64, err error) SendAudit {
+	a := SendAudit{
+		Time:     start,
+		Duration: d,
+		Size:     size,
+		To:       headerAddresses(m, "To"),
+		Cc:       headerAddresses(m, "Cc"),
+		Bcc:      headerAddresses(m, "Bcc"),
+		Err:      err,
+	}
+	if id := m.GetHeader("Message-ID"); len(id) > 0 {
+		a.MessageID = strings.Trim(id[0], "<>")
+	}
+	if subject := m.GetHeader("Subject"); len(subject) > 0 {
+		a.Subject = subject[0]
+		if v, err := new(mime.WordDecoder).DecodeHeader(subject[0]); err == nil {
+			a.Subject = v
+		}
+	}
+	return a
+}
+
+// headerAddresses returns email addresses from the message header field,
+// skipping values that can not be parsed.
+func headerAddresses(m *mail.Message, field string) (addresses []string) {
+	for _, v := range m.GetHeader(field) {
+		a, err := netmail.ParseAddress(v)
+		if err != nil {
+			continue
+		}
+		addresses = append(addresses, a.Address)
+	}
+	return addresses
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServiceAfterSend(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	var audits []SendAudit
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+		MessageIDFunc: func(string) string {
+			return "audit-1@gopherpit.com"
+		},
+		AfterSend: func(a SendAudit) {
+			audits = append(audits, a)
+		},
+	}
+
+	headers := map[string][]string{
+		"Cc":  {`"GopherPit Support" <support@gopherpit.com>`},
+		"Bcc": {"archive@gopherpit.com", `"Compliance" <compliance@gopherpit.com>`},
+	}
+
+	start := time.Now()
+	if err := service.SendEmailWithHeaders("gopher@gopherpit.com", []string{`"Contact" <contact@gopherpit.com>`}, "тест subject", "test body", headers); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	recorder.SetReply("RCPT", "550 5.1.1 User unknown")
+	err = service.SendEmailWithHeaders("gopher@gopherpit.com", []string{"contact@gopherpit.com"}, "test subject", "test body", map[string][]string{
+		"Bcc": {"archive@gopherpit.com"},
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	if len(audits) != 2 {
+		t.Fatalf("expected 2 audit records, got %v", len(audits))
+	}
+
+	a := audits[0]
+	if a.MessageID != "audit-1@gopherpit.com" {
+		t.Errorf("expected message id %q, got %q", "audit-1@gopherpit.com", a.MessageID)
+	}
+	if a.Time.Before(start) {
+		t.Errorf("audit time %s is before send start %s", a.Time, start)
+	}
+	if a.Subject != "тест subject" {
+		t.Errorf("expected subject %q, got %q", "тест subject", a.Subject)
+	}
+	if a.Duration <= 0 || a.Duration > time.Since(start) {
+		t.Errorf("unexpected duration %s", a.Duration)
+	}
+	// Transmitted data is larger as line endings are normalized.
+	if max := int64(len(recorder.Message().Data)); a.Size <= 0 || a.Size > max {
+		t.Errorf("expected size up to %v, got %v", max, a.Size)
+	}
+	if want := []string{"contact@gopherpit.com"}; !reflect.DeepEqual(a.To, want) {
+		t.Errorf("expected to %q, got %q", want, a.To)
+	}
+	if want := []string{"support@gopherpit.com"}; !reflect.DeepEqual(a.Cc, want) {
+		t.Errorf("expected cc %q, got %q", want, a.Cc)
+	}
+	if want := []string{"archive@gopherpit.com", "compliance@gopherpit.com"}; !reflect.DeepEqual(a.Bcc, want) {
+		t.Errorf("expected bcc %q, got %q", want, a.Bcc)
+	}
+	if a.Err != nil {
+		t.Errorf("expected no error, got %v", a.Err)
+	}
+
+	a = audits[1]
+	if want := []string{"archive@gopherpit.com"}; !reflect.DeepEqual(a.Bcc, want) {
+		t.Errorf("expected bcc %q, got %q", want, a.Bcc)
+	}
+	var e *SMTPError
+	if !errors.As(a.Err, &e) || e.Code != 550 {
+		t.Errorf("expected smtp error with code 550, got %v", a.Err)
+	}
+}
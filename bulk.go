@@ -0,0 +1,60 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import "sync"
+
+// RecipientResult is the result of sending a message to one recipient with
+// SendBulk.
+type RecipientResult struct {
+	// Recipient address.
+	Recipient string
+	// Error returned by sending the message, nil if it is sent.
+	Err error
+}
+
+// SendBulk sends the message to every recipient separately, with the
+// recipient as the only To address and as the only envelope recipient.
+// Message To, Cc and Bcc addresses are ignored. At most Service.Concurrency
+// messages are sent at the same time. Results are returned in the order of
+// recipients.
+func (s Service) SendBulk(msg *Message, recipients []string) []RecipientResult {
+	results := make([]RecipientResult, len(recipients))
+	for i, r := range recipients {
+		results[i].Recipient = r
+	}
+
+	concurrency := s.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > len(recipients) {
+		concurrency = len(recipients)
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				m := *msg
+				m.To = []string{recipients[i]}
+				m.Cc = nil
+				m.Bcc = nil
+				results[i].Err = s.Send(&m)
+			}
+		}()
+	}
+	for i := range recipients {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
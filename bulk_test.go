@@ -0,0 +1,98 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServiceSendBulk(t *testing.T) {
+	transport := &bulkTransport{
+		reject: "gopher13@gopherpit.com",
+	}
+	service := Service{
+		Transport:   transport,
+		Concurrency: 4,
+	}
+
+	recipients := make([]string, 50)
+	for i := range recipients {
+		recipients[i] = fmt.Sprintf("gopher%d@gopherpit.com", i)
+	}
+	results := service.SendBulk(&Message{
+		From:     "noreply@gopherpit.com",
+		To:       []string{"ignored@gopherpit.com"},
+		Bcc:      []string{"ignored@gopherpit.com"},
+		Subject:  "test subject",
+		TextBody: "test body",
+	}, recipients)
+
+	if len(results) != len(recipients) {
+		t.Fatalf("got %v results, expected %v", len(results), len(recipients))
+	}
+	for i, r := range results {
+		if r.Recipient != recipients[i] {
+			t.Errorf("result %v: got recipient %q, expected %q", i, r.Recipient, recipients[i])
+		}
+		if r.Recipient == transport.reject {
+			var e *SendError
+			if !errors.As(r.Err, &e) || e.Stage != StageRcpt {
+				t.Errorf("result %v: expected SendError at stage %v, got %v", i, StageRcpt, r.Err)
+			}
+			continue
+		}
+		if r.Err != nil {
+			t.Errorf("result %v: %v", i, r.Err)
+		}
+	}
+
+	messages := transport.Messages()
+	if len(messages) != len(recipients)-1 {
+		t.Fatalf("got %v messages, expected %v", len(messages), len(recipients)-1)
+	}
+	for _, m := range messages {
+		if len(m.To) != 1 || !strings.Contains(string(m.Data), "To: "+m.To[0]+"\r\n") {
+			t.Errorf("message to %q is not addressed to only one recipient", m.To)
+		}
+	}
+	if transport.max > service.Concurrency {
+		t.Errorf("got %v concurrent sends, expected at most %v", transport.max, service.Concurrency)
+	}
+}
+
+// bulkTransport rejects messages to one recipient and records the maximal
+// number of concurrent sends.
+type bulkTransport struct {
+	MemoryTransport
+	reject string
+
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (t *bulkTransport) Send(from string, to []string, msg []byte) error {
+	t.mu.Lock()
+	t.current++
+	t.max = max(t.max, t.current)
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.current--
+		t.mu.Unlock()
+	}()
+
+	time.Sleep(time.Millisecond)
+	if to[0] == t.reject {
+		return &SendError{Stage: StageRcpt, Code: 550, Err: &SMTPError{Command: "RCPT", Code: 550, Message: "User unknown"}}
+	}
+	return t.MemoryTransport.Send(from, to, msg)
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrDSNUnsupported is returned when delivery status notifications are
+// requested with DSN.Required and the SMTP server does not support the DSN
+// extension, or the message is sent with Service.SendmailPath or
+// Service.Transport, which can not request them.
+var ErrDSNUnsupported = errors.New("email: delivery status notifications not supported")
+
+// DSNReturn specifies which part of the message is returned in a failure
+// delivery status notification.
+type DSNReturn string
+
+// Parts of the message returned in delivery status notifications.
+const (
+	// The server decides what to return.
+	DSNReturnDefault DSNReturn = ""
+	// The whole message is returned.
+	DSNReturnFull DSNReturn = "FULL"
+	// Only the message headers are returned.
+	DSNReturnHeaders DSNReturn = "HDRS"
+)
+
+// DSN requests delivery status notifications, as defined in RFC 3461, that
+// are sent to the envelope sender. The options are sent as RET parameter of
+// MAIL FROM and NOTIFY parameter of RCPT TO commands, only if the SMTP server
+// advertises the DSN extension.
+type DSN struct {
+	// Notify on successful delivery.
+	NotifyOnSuccess bool
+	// Notify on delivery failure.
+	NotifyOnFailure bool
+	// Notify if delivery is delayed.
+	NotifyOnDelay bool
+	// Part of the message returned on failure.
+	Return DSNReturn
+	// If true, ErrDSNUnsupported is returned when the SMTP server does not
+	// support the DSN extension, or when the message is sent with
+	// Service.SendmailPath or Service.Transport, instead of sending the
+	// message without requesting notifications.
+	Required bool
+}
+
+func (d DSN) requested() bool {
+	return d.NotifyOnSuccess || d.NotifyOnFailure || d.NotifyOnDelay || d.Return != DSNReturnDefault
+}
+
+// mailParams returns MAIL FROM command parameters with a leading space.
+func (d DSN) mailParams() string {
+	if d.Return == DSNReturnDefault {
+		return ""
+	}
+	return " RET=" + string(d.Return)
+}
+
+// rcptParams returns RCPT TO command parameters with a leading space.
+func (d DSN) rcptParams() string {
+	var notify []string
+	if d.NotifyOnSuccess {
+		notify = append(notify, "SUCCESS")
+	}
+	if d.NotifyOnFailure {
+		notify = append(notify, "FAILURE")
+	}
+	if d.NotifyOnDelay {
+		notify = append(notify, "DELAY")
+	}
+	if len(notify) == 0 {
+		return ""
+	}
+	return " NOTIFY=" + strings.Join(notify, ",")
+}
+
+// required reports whether the message must not be sent without requesting
+// delivery status notifications.
+func (d DSN) required() bool {
+	return d.Required && d.requested()
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServiceDSN(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		extensions []string
+		dsn        DSN
+		want       []string
+		wantErr    error
+	}{
+		{
+			name:       "all options",
+			extensions: []string{"DSN"},
+			dsn:        DSN{NotifyOnSuccess: true, NotifyOnFailure: true, NotifyOnDelay: true, Return: DSNReturnHeaders},
+			want: []string{
+				"MAIL FROM:<gopher@gopherpit.com> RET=HDRS",
+				"RCPT TO:<support@gopherpit.com> NOTIFY=SUCCESS,FAILURE,DELAY",
+				"RCPT TO:<sales@gopherpit.com> NOTIFY=SUCCESS,FAILURE,DELAY",
+			},
+		},
+		{
+			name:       "failure only",
+			extensions: []string{"DSN", "PIPELINING"},
+			dsn:        DSN{NotifyOnFailure: true},
+			want: []string{
+				"MAIL FROM:<gopher@gopherpit.com>",
+				"RCPT TO:<support@gopherpit.com> NOTIFY=FAILURE",
+				"RCPT TO:<sales@gopherpit.com> NOTIFY=FAILURE",
+			},
+		},
+		{
+			name:       "return only",
+			extensions: []string{"DSN"},
+			dsn:        DSN{Return: DSNReturnFull},
+			want: []string{
+				"MAIL FROM:<gopher@gopherpit.com> RET=FULL",
+				"RCPT TO:<support@gopherpit.com>",
+				"RCPT TO:<sales@gopherpit.com>",
+			},
+		},
+		{
+			name: "unsupported",
+			dsn:  DSN{NotifyOnSuccess: true, Return: DSNReturnFull},
+			want: []string{
+				"MAIL FROM:<gopher@gopherpit.com>",
+				"RCPT TO:<support@gopherpit.com>",
+				"RCPT TO:<sales@gopherpit.com>",
+			},
+		},
+		{
+			name:    "unsupported required",
+			dsn:     DSN{NotifyOnSuccess: true, Required: true},
+			wantErr: ErrDSNUnsupported,
+		},
+		{
+			name:       "not requested",
+			extensions: []string{"DSN"},
+			dsn:        DSN{Required: true},
+			want: []string{
+				"MAIL FROM:<gopher@gopherpit.com>",
+				"RCPT TO:<support@gopherpit.com>",
+				"RCPT TO:<sales@gopherpit.com>",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder, err := newSMTPRecorder(t, tc.extensions...)
+			if err != nil {
+				t.Fatalf("smtp listen: %s", err)
+			}
+
+			service := Service{
+				SMTPHost: "localhost",
+				SMTPPort: recorder.Port,
+			}
+			err = service.Send(&Message{
+				From:     "gopher@gopherpit.com",
+				To:       []string{"support@gopherpit.com", "sales@gopherpit.com"},
+				Subject:  "test subject",
+				TextBody: "test body",
+				DSN:      tc.dsn,
+			})
+			if tc.wantErr != nil {
+				var e *SendError
+				if !errors.Is(err, tc.wantErr) || !errors.As(err, &e) || e.Stage != StageMailFrom {
+					t.Fatalf("expected error %v at stage %v, got %v", tc.wantErr, StageMailFrom, err)
+				}
+			} else if err != nil {
+				t.Fatalf("send: %s", err)
+			}
+
+			var got []string
+			for _, c := range recorder.Commands() {
+				if strings.HasPrefix(c, "MAIL ") || strings.HasPrefix(c, "RCPT ") {
+					got = append(got, c)
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got commands %q, expected %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestServiceDSNRequiredDelivery(t *testing.T) {
+	sendmailPath, _ := newTestSendmail(t, 0)
+
+	for _, tc := range []struct {
+		name    string
+		service Service
+	}{
+		{
+			name:    "sendmail",
+			service: Service{SendmailPath: sendmailPath},
+		},
+		{
+			name:    "transport",
+			service: Service{Transport: new(MemoryTransport)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := &Message{
+				From:     "gopher@gopherpit.com",
+				To:       []string{"support@gopherpit.com"},
+				Subject:  "test subject",
+				TextBody: "test body",
+				DSN:      DSN{NotifyOnFailure: true, Required: true},
+			}
+			if err := tc.service.Send(msg); !errors.Is(err, ErrDSNUnsupported) {
+				t.Fatalf("expected error %v, got %v", ErrDSNUnsupported, err)
+			}
+
+			msg.DSN.Required = false
+			if err := tc.service.Send(msg); err != nil {
+				t.Fatalf("send: %s", err)
+			}
+		})
+	}
+}
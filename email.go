@@ -6,33 +6,300 @@
 package email // import "resenje.org/email"
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand/v2"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"golang.org/x/net/idna"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/time/rate"
 	"gopkg.in/mail.v2"
 )
 
+// Sender sends email messages.
+type Sender interface {
+	SendEmail(from string, to []string, subject string, body string) error
+	SendEmailWithHeaders(from string, to []string, subject string, body string, headers map[string][]string) error
+	Notify(subject, body string) error
+	NotifyWithHeaders(subject, body string, headers map[string][]string) error
+}
+
+var _ Sender = Service{}
+
 // Service provides functionality to send emails over SMTP server.
 type Service struct {
 	// SMTP server host.
 	SMTPHost string
 	// SMTP server port.
 	SMTPPort int
+	// SMTP servers that are tried in order when sending to SMTPHost fails
+	// with a connection, authentication or temporary error. Sending stops at
+	// the first server that permanently rejects the message or its
+	// recipients. Fallback servers are not used by Pool.
+	SMTPFallbackServers []SMTPServer
+	// Path to a sendmail compatible program, such as /usr/sbin/sendmail. If
+	// it is set, messages are delivered by executing it instead of over SMTP,
+	// and SMTP options are not used.
+	SendmailPath string
+	// Transport, if set, delivers messages instead of SMTP or sendmail.
+	Transport Transport
+	// Establish a TLS connection before the SMTP session starts, as required
+	// by SMTPS servers, instead of upgrading the connection with STARTTLS
+	// command. It is always done on port 465.
+	SMTPImplicitTLS bool
+	// Maximal duration of establishing TCP connection to the SMTP server.
+	// The default is 10 seconds.
+	DialTimeout time.Duration
+	// Maximal duration of a complete SMTP session for one message, from
+	// connecting to the server until the message is accepted. The connection
+	// is closed and a timeout error is returned when it elapses. The default
+	// is 30 seconds.
+	SendTimeout time.Duration
+	// Maximal duration that Pool keeps an unused connection open for the
+	// next message. A connection that is idle for longer is terminated with
+	// QUIT and a new one is established. If it is zero, idle connections are
+	// reused until the server closes them.
+	SMTPIdleTimeout time.Duration
 	// Do not verify SMTP hostname over encrypted connection.
 	SMTPSkipVerify bool
-	// SMTP identity.
+	// TLS configuration for STARTTLS and implicit TLS connections to the
+	// SMTP server, for example with custom root certificates or server name.
+	// If it is set, it replaces the one derived from SMTPSkipVerify, and
+	// ServerName is set to SMTPHost if it is empty. It must not be modified
+	// after it is used.
+	SMTPTLSConfig *tls.Config
+	// SMTPTLSConfigFunc, if set, returns the TLS configuration for every
+	// connection to the SMTP server with SMTPHost as the argument. A non-nil
+	// configuration replaces the one derived from SMTPSkipVerify and
+	// SMTPTLSConfig, with ServerName set to SMTPHost if it is empty, and
+	// sending fails if it returns an error.
+	SMTPTLSConfigFunc func(host string) (*tls.Config, error)
+	// Require the SMTP server to staple an OCSP response which confirms that
+	// its certificate is not revoked. STARTTLS becomes mandatory if it is set.
+	SMTPRequireOCSPStaple bool
+	// Duration to wait after STARTTLS before EHLO is sent again, for servers
+	// that fail to handle commands immediately after the TLS handshake.
+	SMTPStartTLSDelay time.Duration
+	// If set, the greeting of the SMTP server must match it, for example to
+	// contain the expected server host name. It is checked before STARTTLS,
+	// as an additional check to the TLS certificate verification.
+	SMTPExpectBanner *regexp.Regexp
+	// SMTPCommandFormatter, if set, returns the line that is written for
+	// every SMTP command, without the line terminator, from the command verb
+	// and its parameters. It is intended only for interoperability with
+	// servers that do not accept standard commands. By default, the verb and
+	// parameters are separated by a single space.
+	SMTPCommandFormatter func(verb, params string) string
+	// SMTP identity, the name sent in EHLO or HELO command. Receiving servers
+	// may compare it with the reverse DNS name of the client address. If it
+	// is not set, Hostname is used.
 	SMTPIdentity string
 	// Username for SMTP server authentication.
 	SMTPUsername string
 	// Password for SMTP server authentication.
 	SMTPPassword string
+	// Authenticate with SMTPUsername and SMTPPassword even if the connection
+	// is not encrypted. Credentials are sent only over TLS connections, or
+	// to localhost, if it is not set.
+	SMTPAllowInsecureAuth bool
+	// Authorization identity for SMTP PLAIN authentication, if it is
+	// different from SMTPUsername.
+	SMTPAuthorizationIdentity string
+	// Mechanism of the authentication with SMTPUsername and SMTPPassword.
+	// If it is not set, it is selected from the ones that the server
+	// supports.
+	SMTPAuthMechanism AuthMechanism
+	// Authentication mechanism, such as the one returned by OAuth2Auth. If it
+	// is set, it is used instead of SMTPUsername and SMTPPassword.
+	SMTPAuth smtp.Auth
 	// Adressess fot Notify method.
 	NotifyAddresses []string
 	// From address for Notify method.
 	DefaultFrom string
+	// Envelope addresses are always sent with domains in lower case. If true,
+	// local parts are also changed to lower case, even if they may be case
+	// sensitive, to avoid sending duplicate messages to the same mailbox.
+	LowercaseLocalPart bool
+	// If true, envelope recipients that differ only by a plus tag in the
+	// local part, like gopher+news@example.com and gopher@example.com, are
+	// considered to be the same mailbox and only the first of them is used.
+	DeduplicatePlusTags bool
+	// If set, only these addresses are allowed as the SMTP envelope sender.
+	// The envelope sender is Message.EnvelopeFrom, or the one provided to
+	// SendEmailWithEnvelopeFrom or SendRawWithEnvelope, and otherwise it is
+	// taken from Sender header, or From header if Sender is not set.
+	// Addresses are compared case-insensitively.
+	AllowedEnvelopeFrom []string
+	// Display name that is added to the From address if it does not have one.
+	DefaultFromName string
+	// Reply-To address of messages that do not have Reply-To header.
+	DefaultReplyTo string
 	// Subject prefix for Notify method. It is not space separated from subject value.
 	SubjectPrefix string
+	// Maximal number of characters in the subject. Longer subjects are
+	// truncated and end with an ellipsis. Subjects are not truncated if it is
+	// zero.
+	MaxSubjectLength int
+	// Body for Notify method that is sent when the body argument is empty.
+	NotifyDefaultBody string
+	// MessageIDFunc, if set, returns the value of Message-ID header for every
+	// message that does not have it set in headers. From address is passed
+	// as the argument. The value is wrapped in angle brackets if they are
+	// missing.
+	MessageIDFunc func(from string) string
+	// Host name of the local system. It is used as SMTP identity if
+	// SMTPIdentity is not set, and as a domain of the generated Message-ID
+	// header if MessageIDFunc is not set. If both SMTPIdentity and Hostname
+	// are not set, the host name reported by the operating system is used as
+	// SMTP identity, or "localhost" if it is not available, and if both
+	// MessageIDFunc and Hostname are not set, Message-ID header is generated
+	// with the domain of the From address.
+	Hostname string
+	// Charset of the message body. If it is not set, it is detected from the
+	// body content, defaulting to UTF-8. Bodies that are valid UTF-8 are
+	// converted to this charset, and the other ones are assumed to be already
+	// encoded in it. Sending fails if the charset is not supported or the
+	// body has characters that can not be represented in it.
+	Charset string
+	// Content transfer encoding of the message body. If it is not set,
+	// quoted-printable or base64 is chosen, whichever produces a smaller
+	// message.
+	Encoding Encoding
+	// Templates used by SendTemplate to render message bodies.
+	Template *Template
+	// Enabled, if set, is called before every message is sent. If it returns
+	// false, the message is not sent and ErrSendingDisabled is returned.
+	Enabled func() bool
+	// Return nil instead of ErrSendingDisabled when sending is disabled.
+	DisabledNoOp bool
+	// If set, messages are sent only in the defined hours of a day.
+	SendWindow *SendWindow
+	// Now, if set, is used instead of time.Now to get the current time.
+	Now func() time.Time
+	// If true, every message is parsed back after it is built and it is not
+	// sent if its address and subject headers, or its plain text and HTML
+	// bodies, differ from what was provided.
+	VerifyMessages bool
+	// Number of times sending is retried after a temporary failure, as
+	// reported by SendError.IsTemporary.
+	RetryAttempts int
+	// Duration to wait before the first retry. It is doubled for every
+	// following retry and randomly reduced by up to a half to spread retries
+	// of concurrent sends.
+	RetryBackoff time.Duration
+	// RateLimiter, if set, limits the rate of send attempts, including
+	// retries. Sending blocks until the limiter allows it, or until the
+	// context passed to SendRawWithEnvelope is done. The same limiter should
+	// be used by all services that send through a rate limited server, for
+	// example rate.NewLimiter(10, 1) for at most 10 messages per second.
+	RateLimiter *rate.Limiter
+	// Maximum number of messages that SendBulk sends at the same time. If it
+	// is not positive, messages are sent one at a time.
+	Concurrency int
+	// If set, statistics of sent messages are collected in it.
+	Stats *SendStats
+	// If set, measurements of sent messages are reported to it.
+	Metrics Metrics
+	// AfterSend, if set, is called after every attempt to send a message,
+	// regardless of its success, with the record of message recipients, size
+	// and the duration of sending. It can be used to log every send.
+	AfterSend func(audit SendAudit)
+	// AfterNoOp, if set, is called when a message is not sent without an
+	// attempt to connect to the SMTP server, with the reason why. It is
+	// called regardless of whether an error is returned, so that messages
+	// which are intentionally not sent can be told apart from sent ones.
+	// The reason can also be obtained from the returned error with
+	// NoOpReasonOf.
+	AfterNoOp func(reason NoOpReason)
+
+	// transport, if set, is used instead of a new SMTP session to deliver
+	// messages.
+	transport func(ctx context.Context, from string, to []string, content io.WriterTo, opts sendOptions) (int64, error)
 }
 
+// ErrSendingDisabled is returned when a message is not sent because
+// Service.Enabled returned false.
+var ErrSendingDisabled = errors.New("email: sending disabled")
+
+// Defaults for Service.DialTimeout and Service.SendTimeout.
+const (
+	dialTimeout = 10 * time.Second
+	sendTimeout = 30 * time.Second
+)
+
+// ErrEnvelopeFromNotAllowed is returned when the envelope sender address is
+// not one of Service.AllowedEnvelopeFrom addresses.
+var ErrEnvelopeFromNotAllowed = errors.New("email: envelope sender not allowed")
+
+// ErrInvalidDefaultFrom is returned by Notify methods when
+// Service.DefaultFrom is not a valid address.
+var ErrInvalidDefaultFrom = errors.New("email: invalid DefaultFrom address")
+
+// ErrInvalidAddress is returned when an address of a message can not be
+// parsed. Messages with invalid addresses are not sent.
+var ErrInvalidAddress = errors.New("email: invalid address")
+
+// Encoding is a content transfer encoding of the message body.
+type Encoding string
+
+// Supported content transfer encodings.
+const (
+	// AutoEncoding selects quoted-printable or base64 encoding, whichever
+	// produces a smaller message body.
+	AutoEncoding Encoding = ""
+	// QuotedPrintable is quoted-printable encoding, as defined in RFC 2045.
+	QuotedPrintable Encoding = "quoted-printable"
+	// Base64 is base64 encoding, as defined in RFC 2045.
+	Base64 Encoding = "base64"
+	// EightBit sends the body unencoded, or quoted-printable encoded if it
+	// has lines longer than 998 octets. Messages are sent with BODY=8BITMIME
+	// parameter, as defined in RFC 6152, to SMTP servers that support 8BITMIME
+	// extension. For other servers, unencoded parts are encoded as
+	// quoted-printable before sending, which buffers the message in memory.
+	EightBit Encoding = "8bit"
+)
+
+// AuthMechanism is an SMTP authentication mechanism.
+type AuthMechanism string
+
+// Supported authentication mechanisms.
+const (
+	// AuthAuto selects CRAM-MD5 if the server supports it, LOGIN if the
+	// server supports it but not PLAIN, and PLAIN otherwise. PLAIN is
+	// always used with Service.SMTPAuthorizationIdentity.
+	AuthAuto AuthMechanism = ""
+	// AuthPlain is PLAIN mechanism, as defined in RFC 4616.
+	AuthPlain AuthMechanism = "PLAIN"
+	// AuthLogin is LOGIN mechanism.
+	AuthLogin AuthMechanism = "LOGIN"
+	// AuthCRAMMD5 is CRAM-MD5 mechanism, as defined in RFC 2195.
+	AuthCRAMMD5 AuthMechanism = "CRAM-MD5"
+)
+
+// ErrInvalidMessageID is returned when Service.MessageIDFunc returns a value
+// that can not be used as a Message-ID header.
+var ErrInvalidMessageID = errors.New("email: invalid message id")
+
 // SendEmail sends an email message.
 func (s Service) SendEmail(from string, to []string, subject string, body string) error {
 	return s.SendEmailWithHeaders(from, to, subject, body, nil)
@@ -40,24 +307,1055 @@ func (s Service) SendEmail(from string, to []string, subject string, body string
 
 // SendEmailWithHeaders sends an email message with additional headers.
 func (s Service) SendEmailWithHeaders(from string, to []string, subject string, body string, headers map[string][]string) error {
+	return s.sendEmail("", from, to, subject, body, headers)
+}
+
+// SendEmailWithEnvelopeFrom sends an email message with envelopeFrom as the
+// envelope sender, instead of the From header address. The envelope sender
+// receives delivery status notifications and bounces, and the From header is
+// not changed. If envelopeFrom is empty, the message is sent as with
+// SendEmail.
+func (s Service) SendEmailWithEnvelopeFrom(envelopeFrom, from string, to []string, subject string, body string) error {
+	return s.sendEmail(envelopeFrom, from, to, subject, body, nil)
+}
+
+func (s Service) sendEmail(envelopeFrom, from string, to []string, subject string, body string, headers map[string][]string) error {
+	if !s.enabled() {
+		return s.disabledError()
+	}
+	m, err := s.newMessage(from, to, subject, headers)
+	if err != nil {
+		return err
+	}
+	if body == "" {
+		// Empty body is sent as a single empty line to keep the DATA section
+		// framed in the same way as for any other message.
+		body = "\r\n"
+	}
+	b, err := s.setTextBody(m, body)
+	if err != nil {
+		return err
+	}
+
+	return s.sendMessageFrom(context.Background(), m, envelopeFrom, DSN{}, m, b)
+}
+
+// SendHTMLEmail sends an email message with HTML body. The message is sent
+// as multipart/alternative with a plain text part, generated from the HTML
+// body with HTMLToText, for clients that do not display HTML.
+func (s Service) SendHTMLEmail(from string, to []string, subject string, htmlBody string) error {
+	return s.SendAlternative(from, to, subject, HTMLToText(htmlBody), htmlBody)
+}
+
+// SendAlternative sends a multipart/alternative email message with exactly
+// the provided plain text and HTML parts, without any generated content.
+func (s Service) SendAlternative(from string, to []string, subject string, text, html string) error {
+	if !s.enabled() {
+		return s.disabledError()
+	}
+	m, err := s.newMessage(from, to, subject, nil)
+	if err != nil {
+		return err
+	}
+	b, err := s.setAlternative(m, text, html)
+	if err != nil {
+		return err
+	}
+
+	return s.sendMessage(m, m, b)
+}
+
+// setTextBody sets the plain text message body and returns it as it is set
+// in the message part.
+func (s Service) setTextBody(m *mail.Message, body string) (messageBody, error) {
+	if err := s.setCharset(m, body); err != nil {
+		return messageBody{}, err
+	}
+	body, err := s.encodeBody(body)
+	if err != nil {
+		return messageBody{}, err
+	}
+	encoding, err := s.partEncoding(body)
+	if err != nil {
+		return messageBody{}, err
+	}
+	m.SetBody("text/plain", body, encoding)
+	return messageBody{text: body}, nil
+}
+
+// setAlternative sets the plain text and HTML parts of the message body and
+// returns them as they are set in the message parts.
+func (s Service) setAlternative(m *mail.Message, text, html string) (messageBody, error) {
+	if err := s.setCharset(m, text+html); err != nil {
+		return messageBody{}, err
+	}
+	text, err := s.encodeBody(text)
+	if err != nil {
+		return messageBody{}, err
+	}
+	html, err = s.encodeBody(html)
+	if err != nil {
+		return messageBody{}, err
+	}
+	encoding, err := s.partEncoding(text)
+	if err != nil {
+		return messageBody{}, err
+	}
+	m.SetBody("text/plain", text, encoding)
+	encoding, err = s.partEncoding(html)
+	if err != nil {
+		return messageBody{}, err
+	}
+	m.AddAlternative("text/html", html, encoding)
+	return messageBody{text: text, html: html}, nil
+}
+
+// setCharset sets the charset of message body parts to Service.Charset, or to
+// the charset detected from the body content if it is not set.
+func (s Service) setCharset(m *mail.Message, body string) error {
+	charset := s.Charset
+	if charset == "" {
+		charset = detectCharset(body)
+	} else if _, err := s.charsetEncoding(); err != nil {
+		return err
+	}
+	// Headers are already encoded as UTF-8, so charset is changed only for
+	// the body part.
+	mail.SetCharset(charset)(m)
+	return nil
+}
+
+// charsetEncoding returns the encoding of Service.Charset, or nil if the
+// charset is not set or it is UTF-8.
+func (s Service) charsetEncoding() (encoding.Encoding, error) {
+	if s.Charset == "" {
+		return nil, nil
+	}
+	e, err := ianaindex.MIME.Encoding(s.Charset)
+	if err != nil || e == nil {
+		return nil, fmt.Errorf("email: unsupported charset %q", s.Charset)
+	}
+	if e == unicode.UTF8 {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// encodeBody returns the body converted from UTF-8 to Service.Charset. Body
+// that is not valid UTF-8 is returned unchanged.
+func (s Service) encodeBody(body string) (string, error) {
+	e, err := s.charsetEncoding()
+	if err != nil || e == nil || !utf8.ValidString(body) {
+		return body, err
+	}
+	b, err := e.NewEncoder().String(body)
+	if err != nil {
+		return "", fmt.Errorf("email: body can not be encoded in charset %s: %w", s.Charset, err)
+	}
+	return b, nil
+}
+
+// partEncoding returns the setting for the body part encoding, as defined by
+// Service.Encoding.
+func (s Service) partEncoding(body string) (mail.PartSetting, error) {
+	encoding := s.Encoding
+	switch encoding {
+	case AutoEncoding:
+		encoding = detectEncoding(body)
+	case EightBit:
+		if hasLongLines(body) {
+			encoding = QuotedPrintable
+		}
+	case QuotedPrintable, Base64:
+	default:
+		return nil, fmt.Errorf("email: unsupported encoding %q", encoding)
+	}
+	return mail.SetPartEncoding(mail.Encoding(encoding)), nil
+}
+
+// SendEmailFull sends an email message to To, Cc and Bcc recipients. Bcc
+// recipients receive the message, but they are not listed in its headers.
+func (s Service) SendEmailFull(from string, to, cc, bcc []string, subject string, body string) error {
+	headers := make(map[string][]string)
+	if len(cc) > 0 {
+		headers["Cc"] = cc
+	}
+	if len(bcc) > 0 {
+		headers["Bcc"] = bcc
+	}
+	return s.SendEmailWithHeaders(from, to, subject, body, headers)
+}
+
+// SendEmailWithReadReceipt sends an email message that requests a read
+// receipt to be sent to receiptTo address. Both Disposition-Notification-To
+// and the legacy Return-Receipt-To headers are set.
+func (s Service) SendEmailWithReadReceipt(from string, to []string, subject string, body string, receiptTo string) error {
+	a, err := netmail.ParseAddress(receiptTo)
+	if err != nil {
+		return fmt.Errorf("%w %q: %v", ErrInvalidAddress, receiptTo, err)
+	}
+	return s.SendEmailWithHeaders(from, to, subject, body, map[string][]string{
+		"Disposition-Notification-To": {a.String()},
+		"Return-Receipt-To":           {a.String()},
+	})
+}
+
+// SendDigest sends a multipart/digest email message that bundles messages as
+// its parts. Every element of messages must be a complete RFC 5322 message
+// and it is included as message/rfc822 part, which is the default part type
+// of multipart/digest.
+func (s Service) SendDigest(from string, to []string, subject string, messages [][]byte) error {
+	if !s.enabled() {
+		return s.disabledError()
+	}
+	m, err := s.newMessage(from, to, subject, nil)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, message := range messages {
+		p, err := w.CreatePart(nil)
+		if err != nil {
+			return err
+		}
+		if _, err := p.Write(message); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	m.SetHeader("Content-Type", "multipart/digest; boundary="+w.Boundary())
+
+	var data bytes.Buffer
+	if _, err := m.WriteTo(&data); err != nil {
+		return err
+	}
+	data.WriteString("\r\n")
+	if _, err := body.WriteTo(&data); err != nil {
+		return err
+	}
+
+	return s.sendMessage(m, messageData(data.Bytes()), messageBody{})
+}
+
+func (s Service) enabled() bool {
+	return s.Enabled == nil || s.Enabled()
+}
+
+func (s Service) disabledError() error {
+	s.noOp(Disabled)
+	if s.DisabledNoOp {
+		return nil
+	}
+	return ErrSendingDisabled
+}
+
+func (s Service) newMessage(from string, to []string, subject string, headers map[string][]string) (*mail.Message, error) {
+	// Addresses and Message-ID are validated before headers values are
+	// encoded.
+	replyTo := headers["Reply-To"]
+	if len(replyTo) == 0 && s.DefaultReplyTo != "" {
+		replyTo = []string{s.DefaultReplyTo}
+	}
+	if err := validateAddresses(from, to, headers["Cc"], headers["Bcc"], replyTo); err != nil {
+		return nil, err
+	}
+	id, err := s.messageID(from, headers)
+	if err != nil {
+		return nil, err
+	}
 	m := mail.NewMessage()
-	m.SetHeaders(headers)
-	m.SetHeader("From", from)
-	m.SetHeader("To", to...)
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/plain", body)
+	for field, v := range headers {
+		switch field {
+		case "Reply-To", "Cc", "Bcc":
+			setAddressHeader(m, field, v...)
+		default:
+			m.SetHeader(field, v...)
+		}
+	}
+	if len(headers["Reply-To"]) == 0 && len(replyTo) > 0 {
+		setAddressHeader(m, "Reply-To", replyTo...)
+	}
+	if a, err := netmail.ParseAddress(from); err == nil && a.Name == "" && s.DefaultFromName != "" {
+		a.Name = s.DefaultFromName
+		from = a.String()
+	}
+	setAddressHeader(m, "From", from)
+	if len(to) > 0 {
+		setAddressHeader(m, "To", to...)
+	}
+	m.SetHeader("Subject", truncate(subject, s.MaxSubjectLength))
+	if id != "" {
+		m.SetHeader("Message-ID", id)
+	}
+	return m, nil
+}
 
-	d := mail.NewDialer(
-		s.SMTPHost,
-		s.SMTPPort,
-		s.SMTPUsername,
-		s.SMTPPassword,
-	)
-	d.LocalName = s.SMTPIdentity
-	if s.SMTPSkipVerify {
-		d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+// messageID returns the value of Message-ID header from the headers, from
+// Service.MessageIDFunc, or generated with the domain of Service.Hostname or
+// of the from address, in that order of precedence. Internationalized from
+// domains are converted to IDNA ASCII form, and the host name of the system is
+// used if that fails. Empty string is returned if the domain is not known.
+func (s Service) messageID(from string, headers map[string][]string) (string, error) {
+	if v := headers["Message-ID"]; len(v) > 0 {
+		return formatMessageID(v[0])
+	}
+	if s.MessageIDFunc != nil {
+		return formatMessageID(s.MessageIDFunc(from))
 	}
-	return d.DialAndSend(m)
+	domain := s.Hostname
+	if domain == "" {
+		addr, err := parseAddress(from)
+		if err != nil {
+			return "", nil
+		}
+		i := strings.LastIndexByte(addr, '@')
+		if i < 0 {
+			return "", nil
+		}
+		// Message-ID must be ASCII, as it is not encoded.
+		domain, err = idna.Lookup.ToASCII(strings.ToLower(addr[i+1:]))
+		if err != nil {
+			domain = s.hostname()
+		}
+	}
+	return newMessageID(domain)
+}
+
+// formatMessageID validates the Message-ID header value and wraps it in
+// angle brackets if they are missing.
+func formatMessageID(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, "\r\n") {
+		return "", ErrInvalidMessageID
+	}
+	if !strings.HasPrefix(id, "<") {
+		id = "<" + id
+	}
+	if !strings.HasSuffix(id, ">") {
+		id += ">"
+	}
+	return id, nil
+}
+
+// setAddressHeader sets the address header field. Non-ASCII display names
+// are written as RFC 2047 encoded-words and domains in IDNA ASCII form, so
+// that the message can be sent to servers without SMTPUTF8 extension. Local
+// parts with non-ASCII characters are written in UTF-8, as defined in RFC
+// 6532, as encoded-words are not allowed in addresses.
+func setAddressHeader(m *mail.Message, field string, values ...string) {
+	// SetHeader encodes whole values in place, so they are copied to keep
+	// the originals, and the ones with non-ASCII characters are replaced
+	// after it.
+	h := append([]string(nil), values...)
+	m.SetHeader(field, h...)
+	if allASCII(values) {
+		return
+	}
+	for i, v := range values {
+		if a, err := netmail.ParseAddress(v); err == nil {
+			if addr, err := idnaAddress(a.Address); err == nil {
+				a.Address = addr
+			}
+			h[i] = m.FormatAddress(a.Address, a.Name)
+		}
+	}
+}
+
+// hasUTF8Addresses returns true if any address header field of the message
+// has non-ASCII characters, which remain only in local parts after
+// setAddressHeader.
+func hasUTF8Addresses(m *mail.Message) bool {
+	for _, field := range []string{"From", "Sender", "To", "Cc", "Reply-To"} {
+		if !allASCII(m.GetHeader(field)) {
+			return true
+		}
+	}
+	return false
+}
+
+// truncate returns s with at most max characters, replacing the end of the
+// longer string with an ellipsis. String is not truncated if max is not
+// positive.
+func truncate(s string, max int) string {
+	if max <= 0 || utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	var i int
+	for n := 0; n < max-1; n++ {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+	}
+	return s[:i] + "…"
+}
+
+// newMessageID returns a unique Message-ID header value with the domain part
+// set to the host name.
+func newMessageID(host string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "<" + strconv.FormatInt(time.Now().UnixNano(), 36) + "." + hex.EncodeToString(b) + "@" + host + ">", nil
+}
+
+func (s Service) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// sendMessage sends the content to recipients derived from headers of the
+// message. The body is compared with the content if Service.VerifyMessages
+// is set.
+func (s Service) sendMessage(m *mail.Message, content io.WriterTo, body messageBody) error {
+	return s.sendMessageFrom(context.Background(), m, "", DSN{}, content, body)
+}
+
+// sendMessageFrom sends the content as sendMessage does, with envelopeFrom as
+// the envelope sender if it is not empty, requesting delivery status
+// notifications with dsn.
+func (s Service) sendMessageFrom(ctx context.Context, m *mail.Message, envelopeFrom string, dsn DSN, content io.WriterTo, body messageBody) (err error) {
+	from, to, err := s.envelope(m)
+	if err == nil && envelopeFrom != "" {
+		from, err = s.envelopeAddress(envelopeFrom)
+	}
+	if err == nil && len(to) == 0 {
+		s.noOp(NoRecipients)
+		return ErrNoRecipients
+	}
+	var n int64
+	if s.AfterSend != nil {
+		defer func(start time.Time) {
+			s.AfterSend(newSendAudit(m, start, s.now().Sub(start), n, err))
+		}(s.now())
+	}
+	if err != nil {
+		return err
+	}
+	// Header fields are folded again, as gopkg.in/mail.v2 may write lines
+	// that are longer than the limit.
+	content = foldedMessage{content}
+	if s.VerifyMessages {
+		var buf bytes.Buffer
+		if _, err := content.WriteTo(&buf); err != nil {
+			return err
+		}
+		if err := verifyMessage(m, buf.Bytes(), body); err != nil {
+			return err
+		}
+		content = messageData(buf.Bytes())
+	}
+	n, err = s.deliver(ctx, from, to, content, sendOptions{
+		dsn:         dsn,
+		utf8Headers: hasUTF8Addresses(m),
+	})
+	return err
+}
+
+// SendRaw sends the complete message, as SendRawWithEnvelope does, from
+// the envelope sender to the envelope recipients.
+func (s Service) SendRaw(from string, to []string, raw []byte) error {
+	return s.SendRawWithEnvelope(context.Background(), from, to, raw)
+}
+
+// SendRawWithEnvelope sends the message as it is provided, to the envelope
+// recipients, with envelopeFrom as the envelope sender. No headers are added
+// to the message, and its content is changed only by normalizing line endings
+// to CRLF and by dot-stuffing, as required by SMTP. Service.AfterSend is not
+// called for raw messages, as their headers are not parsed.
+func (s Service) SendRawWithEnvelope(ctx context.Context, envelopeFrom string, recipients []string, rawMessage []byte) error {
+	if !s.enabled() {
+		return s.disabledError()
+	}
+	from, err := s.envelopeAddress(envelopeFrom)
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		s.noOp(NoRecipients)
+		return ErrNoRecipients
+	}
+	to := make([]string, 0, len(recipients))
+	for _, r := range recipients {
+		addr, err := s.envelopeAddress(r)
+		if err != nil {
+			return err
+		}
+		to = append(to, addr)
+	}
+	_, err = s.deliver(ctx, from, to, messageData(rawMessage), sendOptions{})
+	return err
+}
+
+// deliver sends the content to the SMTP server with envelope addresses if
+// sending is allowed by the send window and envelope sender restrictions. It
+// returns the size of the sent content.
+func (s Service) deliver(ctx context.Context, from string, to []string, content io.WriterTo, opts sendOptions) (n int64, err error) {
+	if s.Stats != nil {
+		defer func(start time.Time) {
+			s.Stats.record(n, s.now().Sub(start), err)
+		}(s.now())
+	}
+	if s.Metrics != nil {
+		defer func(start time.Time) {
+			recordMetrics(s.Metrics, n, s.now().Sub(start), err)
+		}(s.now())
+	}
+	// The envelope sender is validated before waiting for the send window
+	// to open, so that messages which would be rejected fail fast.
+	if !s.envelopeFromAllowed(from) {
+		return 0, fmt.Errorf("%w: %s", ErrEnvelopeFromNotAllowed, from)
+	}
+	if err := s.waitSendWindow(ctx); err != nil {
+		return 0, err
+	}
+	send := s.sender()
+	for attempt := 0; ; attempt++ {
+		if s.RateLimiter != nil {
+			if err := s.RateLimiter.Wait(ctx); err != nil {
+				return n, err
+			}
+		}
+		n, err = send(ctx, from, to, content, opts)
+		if err == nil || attempt >= s.RetryAttempts || !isTemporary(err) {
+			break
+		}
+		if s.Stats != nil {
+			s.Stats.retried.Add(1)
+		}
+		if s.Metrics != nil {
+			s.Metrics.Inc(MetricRetried, 1, nil)
+		}
+		if err := sleep(ctx, s.retryDelay(attempt)); err != nil {
+			return n, err
+		}
+	}
+	if err != nil {
+		var e *SendError
+		if !errors.As(err, &e) {
+			e = &SendError{Err: err}
+		}
+		switch {
+		case e.Address != "":
+			// Address of a fallback server is already set.
+		case s.Transport != nil:
+			// Transport address is not known.
+		case s.SendmailPath != "":
+			e.Address = s.SendmailPath
+		default:
+			e.Address = s.address()
+		}
+		return n, e
+	}
+	return n, nil
+}
+
+// sender returns the function that delivers message content over SMTP, with
+// fallback servers or pooled connections, with the sendmail program, or with
+// Service.Transport, as configured.
+func (s Service) sender() func(ctx context.Context, from string, to []string, content io.WriterTo, opts sendOptions) (int64, error) {
+	send := s.send
+	if len(s.SMTPFallbackServers) > 0 {
+		send = s.sendFallback
+	}
+	if s.transport != nil {
+		send = s.transport
+	}
+	if s.SendmailPath != "" {
+		send = s.sendmail
+	}
+	if s.Transport != nil {
+		send = s.sendTransport
+	}
+	return send
+}
+
+// sendTransport delivers the message content with Service.Transport.
+func (s Service) sendTransport(ctx context.Context, from string, to []string, content io.WriterTo, opts sendOptions) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if opts.dsn.required() {
+		return 0, ErrDSNUnsupported
+	}
+	var buf bytes.Buffer
+	if _, err := content.WriteTo(&buf); err != nil {
+		return 0, err
+	}
+	return int64(buf.Len()), s.Transport.Send(from, to, buf.Bytes())
+}
+
+// retryDelay returns the duration to wait before the next attempt, which is
+// doubled after every attempt, with a random jitter of up to a half of it.
+func (s Service) retryDelay(attempt int) time.Duration {
+	return backoffDelay(s.RetryBackoff, attempt)
+}
+
+// backoffDelay returns the backoff doubled for every attempt and randomly
+// reduced by up to a half.
+func backoffDelay(backoff time.Duration, attempt int) time.Duration {
+	d := backoff << attempt
+	if d <= 0 {
+		return 0
+	}
+	return d - mrand.N(d/2+1)
+}
+
+// isTemporary reports whether the error is SendError with a transient
+// failure.
+func isTemporary(err error) bool {
+	var e *SendError
+	return errors.As(err, &e) && e.IsTemporary()
+}
+
+// sleep waits for the duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// messageData is the message content that can be written more than once.
+type messageData []byte
+
+func (d messageData) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(d)
+	return int64(n), err
+}
+
+func (s Service) envelopeFromAllowed(from string) bool {
+	if s.AllowedEnvelopeFrom == nil {
+		return true
+	}
+	for _, a := range s.AllowedEnvelopeFrom {
+		if strings.EqualFold(a, from) {
+			return true
+		}
+	}
+	return false
+}
+
+// address returns the network address of the SMTP server.
+func (s Service) address() string {
+	return net.JoinHostPort(s.SMTPHost, strconv.Itoa(s.SMTPPort))
+}
+
+// send delivers the message content to the SMTP server in a new session. It
+// returns the size of the message content. The session is terminated if the
+// context is canceled.
+func (s Service) send(ctx context.Context, from string, to []string, content io.WriterTo, opts sendOptions) (n int64, err error) {
+	c, err := s.dial(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer c.close()
+
+	stop := context.AfterFunc(ctx, func() {
+		c.close()
+	})
+	defer func() {
+		if !stop() && err != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	n, err = c.sendMail(from, to, content, opts)
+	if err != nil {
+		return n, err
+	}
+	// The message is accepted, so the error on closing the session is
+	// ignored to avoid sending it again.
+	_ = c.quit()
+	return n, nil
+}
+
+// Verify checks that a session with the SMTP server can be established, as
+// for sending a message, including TLS and authentication, and terminates it
+// with QUIT without sending a message. It returns SendError with the stage
+// that failed. It can be used as a readiness check of the SMTP server.
+func (s Service) Verify(ctx context.Context) error {
+	c, err := s.dial(ctx)
+	if err != nil {
+		var e *SendError
+		if errors.As(err, &e) {
+			e.Address = s.address()
+		}
+		return err
+	}
+	// The session is established, so the error on closing it is not
+	// relevant for the check.
+	_ = c.quit()
+	return nil
+}
+
+// durationOr returns d if it is positive, or the default value otherwise.
+func durationOr(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+// dial connects to the SMTP server, upgrades the connection to TLS when it
+// is supported and authenticates if credentials are configured.
+func (s Service) dial(ctx context.Context) (*smtpClient, error) {
+	d := net.Dialer{Timeout: durationOr(s.DialTimeout, dialTimeout)}
+	conn, err := d.DialContext(ctx, "tcp", s.address())
+	if err != nil {
+		return nil, stageError(StageDial, err)
+	}
+	deadline := time.Now().Add(durationOr(s.SendTimeout, sendTimeout))
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, stageError(StageDial, err)
+	}
+	if s.SMTPImplicitTLS || s.SMTPPort == 465 {
+		config, err := s.tlsConfig()
+		if err != nil {
+			conn.Close()
+			return nil, stageError(StageDial, err)
+		}
+		conn = tls.Client(conn, config)
+	}
+
+	c, err := newSMTPClient(conn, s.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return nil, stageError(StageDial, err)
+	}
+	if s.SMTPExpectBanner != nil && !s.SMTPExpectBanner.MatchString(c.greeting) {
+		c.close()
+		return nil, stageError(StageDial, fmt.Errorf("%w: %q", ErrUnexpectedBanner, c.greeting))
+	}
+	c.format = s.SMTPCommandFormatter
+	c.eightBit = s.Encoding == EightBit
+
+	if err := s.handshake(ctx, c); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// helloName returns the name that the client introduces itself with in EHLO
+// or HELO command.
+func (s Service) helloName() string {
+	if s.SMTPIdentity != "" {
+		return s.SMTPIdentity
+	}
+	return s.hostname()
+}
+
+// hostname returns Service.Hostname, or the host name reported by the
+// operating system, or "localhost" if it is not available.
+func (s Service) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return "localhost"
+}
+
+// handshake introduces the client, upgrades the connection to TLS and
+// authenticates, returning SendError with the stage that failed.
+func (s Service) handshake(ctx context.Context, c *smtpClient) error {
+	localName := s.helloName()
+	if err := c.hello(localName); err != nil {
+		return stageError(StageDial, err)
+	}
+
+	if !c.tls {
+		if ok, _ := c.extension("STARTTLS"); ok {
+			config, err := s.tlsConfig()
+			if err != nil {
+				return stageError(StageStartTLS, err)
+			}
+			if err := c.startTLS(ctx, config, localName, s.SMTPStartTLSDelay); err != nil {
+				return stageError(StageStartTLS, err)
+			}
+		} else if s.SMTPRequireOCSPStaple {
+			return stageError(StageStartTLS, ErrStartTLSUnsupported)
+		}
+	}
+
+	a, err := s.auth(c)
+	if err != nil {
+		return stageError(StageAuth, err)
+	}
+	if a != nil {
+		if !c.tls && !isLocalhost(s.SMTPHost) {
+			if !s.SMTPAllowInsecureAuth {
+				return stageError(StageAuth, ErrInsecureAuth)
+			}
+			a = insecureAuth{a}
+		}
+		if err := c.auth(a); err != nil {
+			return stageError(StageAuth, err)
+		}
+	}
+	return nil
+}
+
+// tlsConfig returns the TLS configuration for the connection to the SMTP
+// server, from Service.SMTPTLSConfigFunc or Service.SMTPTLSConfig if they
+// are set, in that order of precedence.
+func (s Service) tlsConfig() (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         s.SMTPHost,
+		InsecureSkipVerify: s.SMTPSkipVerify,
+	}
+	if s.SMTPTLSConfig != nil {
+		c = s.SMTPTLSConfig.Clone()
+		if c.ServerName == "" {
+			c.ServerName = s.SMTPHost
+		}
+	}
+	if s.SMTPTLSConfigFunc != nil {
+		config, err := s.SMTPTLSConfigFunc(s.SMTPHost)
+		if err != nil {
+			return nil, fmt.Errorf("email: tls config: %w", err)
+		}
+		if config != nil {
+			c = config.Clone()
+			if c.ServerName == "" {
+				c.ServerName = s.SMTPHost
+			}
+		}
+	}
+	if s.SMTPRequireOCSPStaple {
+		verify := c.VerifyConnection
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			return verifyOCSPStaple(cs)
+		}
+	}
+	return c, nil
+}
+
+// auth returns the authentication mechanism for the SMTP session or nil if
+// credentials are not configured or the server does not support
+// authentication. Mechanism that is set with Service.SMTPAuthMechanism is
+// used even if the server does not advertise it.
+func (s Service) auth(c *smtpClient) (smtp.Auth, error) {
+	if s.SMTPAuth != nil {
+		return s.SMTPAuth, nil
+	}
+	mechanism := s.SMTPAuthMechanism
+	switch mechanism {
+	case AuthAuto, AuthPlain, AuthLogin, AuthCRAMMD5:
+	default:
+		return nil, fmt.Errorf("email: unsupported auth mechanism %q", mechanism)
+	}
+	if s.SMTPUsername == "" && s.SMTPAuthorizationIdentity == "" {
+		return nil, nil
+	}
+	if mechanism == AuthAuto {
+		ok, mechanisms := c.extension("AUTH")
+		switch {
+		case s.SMTPAuthorizationIdentity != "":
+			mechanism = AuthPlain
+		case !ok:
+			return nil, nil
+		case strings.Contains(mechanisms, "CRAM-MD5"):
+			mechanism = AuthCRAMMD5
+		case strings.Contains(mechanisms, "LOGIN") && !strings.Contains(mechanisms, "PLAIN"):
+			mechanism = AuthLogin
+		default:
+			mechanism = AuthPlain
+		}
+	}
+	switch mechanism {
+	case AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(s.SMTPUsername, s.SMTPPassword), nil
+	case AuthLogin:
+		return &loginAuth{
+			username: s.SMTPUsername,
+			password: s.SMTPPassword,
+			host:     s.SMTPHost,
+		}, nil
+	default:
+		return smtp.PlainAuth(s.SMTPAuthorizationIdentity, s.SMTPUsername, s.SMTPPassword, s.SMTPHost), nil
+	}
+}
+
+// detectCharset returns the name of the charset of the body. ASCII and valid
+// UTF-8 content is reported as UTF-8. Other content is assumed to be in one of
+// the common single byte charsets, Windows-1252 if it contains bytes that are
+// control characters in ISO-8859-1, or ISO-8859-1 otherwise.
+func detectCharset(body string) string {
+	if utf8.ValidString(body) {
+		return "UTF-8"
+	}
+	for i := 0; i < len(body); i++ {
+		if body[i] >= 0x80 && body[i] <= 0x9f {
+			return "Windows-1252"
+		}
+	}
+	return "ISO-8859-1"
+}
+
+// hasLongLines reports whether the body has lines longer than 998 octets,
+// excluding CRLF, which is the limit of SMTP, as defined in RFC 5321.
+func hasLongLines(body string) bool {
+	for len(body) > 998 {
+		i := strings.IndexByte(body, '\n')
+		if i < 0 {
+			return true
+		}
+		if len(strings.TrimSuffix(body[:i], "\r")) > 998 {
+			return true
+		}
+		body = body[i+1:]
+	}
+	return false
+}
+
+// detectEncoding returns the encoding that produces a smaller encoded body.
+// Mostly ASCII content is smaller when encoded as quoted-printable, and
+// content with many non-ASCII bytes when encoded as base64.
+func detectEncoding(body string) Encoding {
+	var qp byteCounter
+	w := quotedprintable.NewWriter(&qp)
+	_, _ = io.WriteString(w, body)
+	_ = w.Close()
+
+	// Base64 encoded body is split into lines of 76 characters.
+	b64 := base64.StdEncoding.EncodedLen(len(body))
+	b64 += (b64 + 75) / 76 * len("\r\n")
+
+	if b64 < int(qp) {
+		return Base64
+	}
+	return QuotedPrintable
+}
+
+// byteCounter is a writer that counts the number of written bytes.
+type byteCounter int
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// envelope returns SMTP envelope sender and recipient addresses of the
+// message. The sender is taken from Sender header, or From header if Sender
+// is not set, and recipients from To, Cc and Bcc headers without duplicates.
+// Recipients are duplicates if their addresses are equal after the domains
+// are changed to lower case. Local parts are compared case-sensitively,
+// unless Service.LowercaseLocalPart is set, and without plus tags if
+// Service.DeduplicatePlusTags is set. Headers are not changed.
+func (s Service) envelope(m *mail.Message) (string, []string, error) {
+	from := m.GetHeader("Sender")
+	if len(from) == 0 {
+		from = m.GetHeader("From")
+		if len(from) == 0 {
+			return "", nil, errors.New(`email: "From" header is absent`)
+		}
+	}
+	sender, err := s.envelopeAddress(from[0])
+	if err != nil {
+		return "", nil, err
+	}
+
+	var recipients []string
+	seen := make(map[string]struct{})
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		for _, v := range m.GetHeader(field) {
+			addr, err := s.envelopeAddress(v)
+			if err != nil {
+				return "", nil, err
+			}
+			mailbox := addr
+			if s.DeduplicatePlusTags {
+				mailbox = withoutPlusTag(addr)
+			}
+			if _, ok := seen[mailbox]; ok {
+				continue
+			}
+			seen[mailbox] = struct{}{}
+			recipients = append(recipients, addr)
+		}
+	}
+	return sender, recipients, nil
+}
+
+// envelopeAddress returns the email address from the address header value
+// with the domain part in lower case, and the local part in lower case if
+// Service.LowercaseLocalPart is set.
+func (s Service) envelopeAddress(v string) (string, error) {
+	addr, err := parseAddress(v)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return addr, nil
+	}
+	local, domain := addr[:i], strings.ToLower(addr[i+1:])
+	if s.LowercaseLocalPart {
+		local = strings.ToLower(local)
+	}
+	return local + "@" + domain, nil
+}
+
+// withoutPlusTag returns the address without the part of the local part
+// that starts with the plus sign.
+func withoutPlusTag(addr string) string {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return addr
+	}
+	j := strings.IndexByte(addr[:i], '+')
+	if j <= 0 {
+		return addr
+	}
+	return addr[:j] + addr[i:]
+}
+
+// validateAddresses returns an error that joins errors of all addresses that
+// can not be parsed.
+func validateAddresses(from string, lists ...[]string) error {
+	var errs []error
+	if _, err := parseAddress(from); err != nil {
+		errs = append(errs, err)
+	}
+	for _, list := range lists {
+		for _, v := range list {
+			if _, err := parseAddress(v); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func parseAddress(s string) (string, error) {
+	a, err := netmail.ParseAddress(s)
+	if err != nil {
+		return "", fmt.Errorf("%w %q: %v", ErrInvalidAddress, s, err)
+	}
+	return a.Address, nil
 }
 
 // Notify sends an email message to Service.NotifyAddresses.
@@ -66,9 +1364,21 @@ func (s Service) Notify(subject, body string) error {
 }
 
 // NotifyWithHeaders sends an email message to Service.NotifyAddresses with additional headers.
+// Headers are passed through as provided, so when a received message is
+// forwarded, its trace headers, like Authentication-Results and
+// Received-SPF, can be preserved. Such headers are not verified and recipients
+// should trust them only if they trust the system that added them, as any
+// sender can forge them. Adding ARC headers is not supported.
 func (s Service) NotifyWithHeaders(subject, body string, headers map[string][]string) error {
 	if len(s.NotifyAddresses) == 0 {
+		s.noOp(NoRecipients)
 		return nil
 	}
+	if _, err := netmail.ParseAddress(s.DefaultFrom); err != nil {
+		return fmt.Errorf("%w %q: %v", ErrInvalidDefaultFrom, s.DefaultFrom, err)
+	}
+	if body == "" {
+		body = s.NotifyDefaultBody
+	}
 	return s.SendEmailWithHeaders(s.DefaultFrom, s.NotifyAddresses, s.SubjectPrefix+subject, body, headers)
 }
@@ -8,28 +8,61 @@ package email
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
 	"net"
 	"net/mail"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
 )
 
 type smtpRecorder struct {
-	Port    int
-	message *smtpMessage
-	mu      sync.Mutex
+	Port       int
+	extensions []string
+	replies    map[string]string
+	queued     map[string][]string
+	tlsConfig  *tls.Config
+	message    *smtpMessage
+	commands   []string
+	mu         sync.Mutex
+}
+
+func newSMTPRecorder(t testing.TB, extensions ...string) (*smtpRecorder, error) {
+	l, err := net.Listen("tcp", "")
+	if err != nil {
+		return nil, err
+	}
+	return listenSMTPRecorder(t, l, extensions...), nil
 }
 
-func newSMTPRecorder(t *testing.T) (*smtpRecorder, error) {
+// newSMTPSRecorder returns a recorder which accepts only TLS connections
+// with the provided configuration.
+func newSMTPSRecorder(t testing.TB, config *tls.Config, extensions ...string) (*smtpRecorder, error) {
 	l, err := net.Listen("tcp", "")
 	if err != nil {
 		return nil, err
 	}
+	return listenSMTPRecorder(t, tls.NewListener(l, config), extensions...), nil
+}
 
+func listenSMTPRecorder(t testing.TB, l net.Listener, extensions ...string) *smtpRecorder {
 	recorder := &smtpRecorder{
-		Port: l.Addr().(*net.TCPAddr).Port,
+		Port:       l.Addr().(*net.TCPAddr).Port,
+		extensions: extensions,
 	}
 
 	go func() {
@@ -38,126 +71,148 @@ func newSMTPRecorder(t *testing.T) (*smtpRecorder, error) {
 			if err != nil {
 				panic(err)
 			}
-			go func(conn net.Conn) {
-				defer conn.Close()
+			go recorder.serve(t, conn)
+		}
+	}()
 
-				reader := bufio.NewReader(conn)
-				writer := bufio.NewWriter(conn)
+	return recorder
+}
 
-				if _, err := writer.WriteString("220 Welcome\r\n"); err != nil {
-					panic(err)
-				}
-				writer.Flush()
+func (r *smtpRecorder) serve(t testing.TB, conn net.Conn) {
+	defer conn.Close()
 
-				s, err := reader.ReadString('\n')
-				if err != nil {
-					panic(err)
-				}
-				t.Log(strings.TrimSpace(s))
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
 
-				if _, err := writer.WriteString("250 Hello\r\n"); err != nil {
-					panic(err)
-				}
-				writer.Flush()
+	reply := func(lines ...string) {
+		for i, line := range lines {
+			sep := " "
+			if i < len(lines)-1 {
+				sep = "-"
+			}
+			if _, err := writer.WriteString(line[:3] + sep + line[4:] + "\r\n"); err != nil {
+				panic(err)
+			}
+		}
+		writer.Flush()
+	}
 
-				s, err = reader.ReadString('\n')
-				if err != nil {
-					panic(err)
-				}
-				t.Log(strings.TrimSpace(s))
+	greeting := r.reply("")
+	if greeting == "" {
+		greeting = "220 Welcome"
+	}
+	reply(strings.Split(greeting, "\n")...)
 
-				if _, err := writer.WriteString("250 Sender\r\n"); err != nil {
-					panic(err)
-				}
-				writer.Flush()
+	for {
+		s, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		s = strings.TrimSpace(s)
+		t.Log(s)
+		r.addCommand(s)
 
-				s, err = reader.ReadString('\n')
+		verb := strings.ToUpper(strings.SplitN(s, " ", 2)[0])
+		if rpl := r.reply(verb); rpl != "" {
+			reply(strings.Split(rpl, "\n")...)
+			continue
+		}
+		switch verb {
+		case "EHLO", "HELO":
+			lines := []string{"250 Hello"}
+			for _, e := range r.extensions {
+				lines = append(lines, "250 "+e)
+			}
+			if _, ok := conn.(*tls.Conn); !ok && r.TLSConfig() != nil {
+				lines = append(lines, "250 STARTTLS")
+			}
+			reply(lines...)
+		case "STARTTLS":
+			reply("220 Ready to start TLS")
+			conn = tls.Server(conn, r.TLSConfig())
+			reader = bufio.NewReader(conn)
+			writer = bufio.NewWriter(conn)
+		case "AUTH":
+			reply("235 Authenticated")
+		case "MAIL":
+			reply("250 Sender")
+		case "RCPT":
+			reply("250 Recipient")
+		case "RSET", "NOOP":
+			reply("250 OK")
+		case "DATA":
+			reply("354 OK send data ending with <CRLF>.<CRLF>")
+			data := []byte{}
+			for {
+				d, err := reader.ReadSlice('\n')
 				if err != nil {
-					panic(err)
-				}
-				t.Log(strings.TrimSpace(s))
-
-				for {
-					if _, err := writer.WriteString("250 Recipient\r\n"); err != nil {
-						panic(err)
-					}
-					writer.Flush()
-
-					s, err = reader.ReadString('\n')
-					if err != nil {
-						panic(err)
-					}
-					s = strings.TrimSpace(s)
-					t.Log(s)
-
-					if s == "DATA" {
-						break
-					}
-				}
-
-				if _, err := writer.WriteString("354 OK send data ending with <CRLF>.<CRLF>\r\n"); err != nil {
-					panic(err)
-				}
-				writer.Flush()
-				data := []byte{}
-				for {
-					d, err := reader.ReadSlice('\n')
-					if err != nil {
-						panic(err)
-					}
-					if d[0] == 46 && d[1] == 13 && d[2] == 10 {
-						break
-					}
-					data = append(data, d...)
+					// The client aborted the transmission.
+					return
 				}
-
-				if _, err := writer.WriteString("250 Server has transmitted the message\n\r"); err != nil {
-					panic(err)
+				if bytes.Equal(d, []byte(".\r\n")) {
+					break
 				}
-				writer.Flush()
-
-				m, err := mail.ReadMessage(bytes.NewReader(data))
-				if err != nil {
-					panic(err)
+				// Remove dot-stuffing.
+				if d[0] == '.' {
+					d = d[1:]
 				}
+				data = append(data, d...)
+			}
+			r.SetMessage(parseSMTPMessage(t, data))
+			reply("250 Server has transmitted the message")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
 
-				t.Log("Date:", m.Header.Get("Date"))
-				t.Log("From:", m.Header.Get("From"))
-				t.Log("To:", m.Header.Get("To"))
-				t.Log("Reply-To:", m.Header.Get("Reply-To"))
-				t.Log("Subject:", m.Header.Get("Subject"))
+func parseSMTPMessage(t testing.TB, data []byte) *smtpMessage {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		panic(err)
+	}
 
-				body, err := ioutil.ReadAll(m.Body)
-				if err != nil {
-					panic(err)
-				}
-				t.Logf("%s", body)
+	t.Log("Date:", m.Header.Get("Date"))
+	t.Log("From:", m.Header.Get("From"))
+	t.Log("To:", m.Header.Get("To"))
+	t.Log("Reply-To:", m.Header.Get("Reply-To"))
+	t.Log("Subject:", m.Header.Get("Subject"))
 
-				message := smtpMessage{}
-				from, err := m.Header.AddressList("From")
-				if err != nil {
-					panic(err)
-				}
-				if len(from) > 0 {
-					message.From = from[0]
-				}
-				message.To, err = m.Header.AddressList("To")
-				if err != nil {
-					panic(err)
-				}
-				message.ReplyTo, err = m.Header.AddressList("Reply-To")
-				if err != nil && err != mail.ErrHeaderNotPresent {
-					panic(err)
-				}
-				message.Subject = m.Header.Get("Subject")
-				message.Body = string(body)
+	body, err := ioutil.ReadAll(m.Body)
+	if err != nil {
+		panic(err)
+	}
+	t.Logf("%s", body)
 
-				recorder.SetMessage(&message)
-			}(conn)
-		}
-	}()
+	message := smtpMessage{
+		Header: m.Header,
+		Data:   data,
+	}
+	from, err := m.Header.AddressList("From")
+	if err != nil {
+		panic(err)
+	}
+	if len(from) > 0 {
+		message.From = from[0]
+	}
+	message.To, err = m.Header.AddressList("To")
+	if err != nil && err != mail.ErrHeaderNotPresent {
+		panic(err)
+	}
+	message.ReplyTo, err = m.Header.AddressList("Reply-To")
+	if err != nil && err != mail.ErrHeaderNotPresent {
+		panic(err)
+	}
+	message.Subject, err = new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		panic(err)
+	}
+	message.Body = string(body)
 
-	return recorder, nil
+	return &message
 }
 
 func (r *smtpRecorder) Message() *smtpMessage {
@@ -172,12 +227,68 @@ func (r *smtpRecorder) SetMessage(m *smtpMessage) {
 	r.message = m
 }
 
+func (r *smtpRecorder) SetReply(verb, reply string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.replies == nil {
+		r.replies = make(map[string]string)
+	}
+	r.replies[verb] = reply
+}
+
+// QueueReplies sets replies that are returned once each, in order, for the
+// following commands with the verb, before the reply set by SetReply.
+func (r *smtpRecorder) QueueReplies(verb string, replies ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.queued == nil {
+		r.queued = make(map[string][]string)
+	}
+	r.queued[verb] = append(r.queued[verb], replies...)
+}
+
+func (r *smtpRecorder) SetTLSConfig(c *tls.Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tlsConfig = c
+}
+
+func (r *smtpRecorder) TLSConfig() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tlsConfig
+}
+
+func (r *smtpRecorder) reply(verb string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if q := r.queued[verb]; len(q) > 0 {
+		r.queued[verb] = q[1:]
+		return q[0]
+	}
+	return r.replies[verb]
+}
+
+func (r *smtpRecorder) Commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.commands...)
+}
+
+func (r *smtpRecorder) addCommand(c string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = append(r.commands, c)
+}
+
 type smtpMessage struct {
+	Header  mail.Header
 	From    *mail.Address
 	To      []*mail.Address
 	ReplyTo []*mail.Address
 	Subject string
 	Body    string
+	Data    []byte
 }
 
 func TestService(t *testing.T) {
@@ -368,6 +479,29 @@ func TestService(t *testing.T) {
 		}
 	})
 
+	t.Run("EmptyBody", func(t *testing.T) {
+		if err := service.SendEmail(from, to, subject, ""); err != nil {
+			t.Errorf("send email: %s", err)
+		}
+
+		recordedBody := recorder.Message().Body
+		if recordedBody != "\r\n" {
+			t.Errorf(`message body: expected "%v", got "%v"`, "\r\n", recordedBody)
+		}
+	})
+
+	t.Run("DotStuffing", func(t *testing.T) {
+		body := "first line\r\n.\r\n..\r\nlast line"
+		if err := service.SendEmail(from, to, subject, body); err != nil {
+			t.Errorf("send email: %s", err)
+		}
+
+		recordedBody := recorder.Message().Body
+		if recordedBody != body+"\r\n" {
+			t.Errorf(`message body: expected "%v", got "%v"`, body, recordedBody)
+		}
+	})
+
 	t.Run("NotifyNoOp", func(t *testing.T) {
 		recorder.SetMessage(nil)
 		service.NotifyAddresses = nil
@@ -379,3 +513,1704 @@ func TestService(t *testing.T) {
 		}
 	})
 }
+
+func TestServiceAuthorizationIdentity(t *testing.T) {
+	recorder, err := newSMTPRecorder(t, "AUTH PLAIN")
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost:                  "localhost",
+		SMTPPort:                  recorder.Port,
+		SMTPUsername:              "authcid",
+		SMTPPassword:              "passwd",
+		SMTPAuthorizationIdentity: "authzid",
+	}
+
+	if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	want := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("authzid\x00authcid\x00passwd"))
+	found := false
+	for _, c := range recorder.Commands() {
+		if c == want {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Errorf("command %q not found in %q", want, recorder.Commands())
+	}
+}
+
+func TestServiceInsecureAuth(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		host    string
+		allow   bool
+		wantErr error
+	}{
+		{
+			name: "localhost",
+			host: "localhost",
+		},
+		{
+			name:    "not allowed",
+			host:    "127.0.0.2",
+			wantErr: ErrInsecureAuth,
+		},
+		{
+			name:  "allowed",
+			host:  "127.0.0.2",
+			allow: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder, err := newSMTPRecorder(t, "AUTH LOGIN PLAIN")
+			if err != nil {
+				t.Fatalf("smtp listen: %s", err)
+			}
+
+			service := Service{
+				SMTPHost:              tc.host,
+				SMTPPort:              recorder.Port,
+				SMTPUsername:          "gopher",
+				SMTPPassword:          "secret",
+				SMTPAllowInsecureAuth: tc.allow,
+			}
+
+			err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+
+			want := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00gopher\x00secret"))
+			var found bool
+			for _, c := range recorder.Commands() {
+				if strings.HasPrefix(c, "AUTH ") {
+					if c != want {
+						t.Errorf("expected command %q, got %q", want, c)
+					}
+					found = true
+				}
+			}
+			if found != (tc.wantErr == nil) {
+				t.Errorf("expected authentication %v, got %v", tc.wantErr == nil, found)
+			}
+		})
+	}
+}
+
+func TestServiceMessageIDFunc(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	from := "gopher@gopherpit.com"
+	to := []string{"support@gopherpit.com"}
+
+	t.Run("Custom", func(t *testing.T) {
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: recorder.Port,
+			MessageIDFunc: func(from string) string {
+				return "campaign-42.1476633600@" + from[strings.Index(from, "@")+1:]
+			},
+		}
+
+		if err := service.SendEmail(from, to, "test subject", "test body"); err != nil {
+			t.Fatalf("send email: %s", err)
+		}
+
+		want := "<campaign-42.1476633600@gopherpit.com>"
+		got := recorder.Message().Header.Get("Message-ID")
+		if got != want {
+			t.Errorf("message id: expected %q, got %q", want, got)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: recorder.Port,
+			MessageIDFunc: func(string) string {
+				return "id@gopherpit.com\r\nBcc: attacker@example.com"
+			},
+		}
+
+		err := service.SendEmail(from, to, "test subject", "test body")
+		if err != ErrInvalidMessageID {
+			t.Errorf("expected error %v, got %v", ErrInvalidMessageID, err)
+		}
+	})
+}
+
+func TestServiceHostname(t *testing.T) {
+	from := "gopher@gopherpit.com"
+	to := []string{"support@gopherpit.com"}
+
+	t.Run("Default", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: recorder.Port,
+			Hostname: "mail.gopherpit.com",
+		}
+
+		if err := service.SendEmail(from, to, "test subject", "test body"); err != nil {
+			t.Fatalf("send email: %s", err)
+		}
+
+		if got := recorder.Commands()[0]; got != "EHLO mail.gopherpit.com" {
+			t.Errorf("expected EHLO with hostname, got %q", got)
+		}
+		id := recorder.Message().Header.Get("Message-ID")
+		if !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@mail.gopherpit.com>") {
+			t.Errorf("expected message id with hostname domain, got %q", id)
+		}
+	})
+
+	t.Run("Override", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+
+		service := Service{
+			SMTPHost:     "localhost",
+			SMTPPort:     recorder.Port,
+			Hostname:     "mail.gopherpit.com",
+			SMTPIdentity: "relay.gopherpit.com",
+			MessageIDFunc: func(string) string {
+				return "campaign-42@gopherpit.com"
+			},
+		}
+
+		if err := service.SendEmail(from, to, "test subject", "test body"); err != nil {
+			t.Fatalf("send email: %s", err)
+		}
+
+		if got := recorder.Commands()[0]; got != "EHLO relay.gopherpit.com" {
+			t.Errorf("expected EHLO with smtp identity, got %q", got)
+		}
+		if got := recorder.Message().Header.Get("Message-ID"); got != "<campaign-42@gopherpit.com>" {
+			t.Errorf("expected message id from function, got %q", got)
+		}
+	})
+}
+
+func TestServiceMessageIDAndDate(t *testing.T) {
+	from := "Gopher <gopher@GopherPit.com>"
+	to := []string{"support@gopherpit.com"}
+
+	t.Run("Headers", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: recorder.Port,
+			MessageIDFunc: func(string) string {
+				return "campaign-42@gopherpit.com"
+			},
+		}
+
+		date := "Sun, 16 Oct 2016 12:00:00 +0200"
+		if err := service.SendEmailWithHeaders(from, to, "test subject", "test body", map[string][]string{
+			"Message-ID": {"order-1001@shop.gopherpit.com"},
+			"Date":       {date},
+		}); err != nil {
+			t.Fatalf("send email: %s", err)
+		}
+
+		m := recorder.Message()
+		if got, want := m.Header.Get("Message-ID"), "<order-1001@shop.gopherpit.com>"; got != want {
+			t.Errorf("message id: expected %q, got %q", want, got)
+		}
+		if got := m.Header.Get("Date"); got != date {
+			t.Errorf("date: expected %q, got %q", date, got)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: recorder.Port,
+		}
+
+		err = service.SendEmailWithHeaders(from, to, "test subject", "test body", map[string][]string{
+			"Message-ID": {"id@gopherpit.com\r\nBcc: attacker@example.com"},
+		})
+		if err != ErrInvalidMessageID {
+			t.Errorf("expected error %v, got %v", ErrInvalidMessageID, err)
+		}
+	})
+
+	t.Run("From domain", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: recorder.Port,
+		}
+
+		if err := service.SendEmail(from, to, "test subject", "test body"); err != nil {
+			t.Fatalf("send email: %s", err)
+		}
+
+		id := recorder.Message().Header.Get("Message-ID")
+		if !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@gopherpit.com>") {
+			t.Errorf("expected message id with from address domain, got %q", id)
+		}
+	})
+
+	t.Run("IDN from domain", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: recorder.Port,
+		}
+
+		if err := service.SendEmail("gopher@Exämple.de", to, "test subject", "test body"); err != nil {
+			t.Fatalf("send email: %s", err)
+		}
+
+		id := recorder.Message().Header.Get("Message-ID")
+		if !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@xn--exmple-cua.de>") {
+			t.Errorf("expected message id with ascii from address domain, got %q", id)
+		}
+	})
+}
+
+func TestServiceInvalidAddresses(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	err = service.SendEmailFull("gopher at gopherpit.com", []string{"support@gopherpit.com", "sales@"}, []string{"<ops@gopherpit.com"}, nil, "test subject", "test body")
+	if !errors.Is(err, ErrInvalidAddress) {
+		t.Fatalf("expected error %v, got %v", ErrInvalidAddress, err)
+	}
+	for _, addr := range []string{"gopher at gopherpit.com", "sales@", "<ops@gopherpit.com"} {
+		if !strings.Contains(err.Error(), strconv.Quote(addr)) {
+			t.Errorf("expected error to contain address %q, got %q", addr, err)
+		}
+	}
+	if strings.Contains(err.Error(), "support@gopherpit.com") {
+		t.Errorf("unexpected valid address in error %q", err)
+	}
+	if commands := recorder.Commands(); len(commands) != 0 {
+		t.Errorf("expected no smtp commands, got %q", commands)
+	}
+}
+
+func TestServiceEncodedWords(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	subject := "Überraschung! " + strings.Repeat("Grüße aus München, ", 5)
+	if err := service.SendEmailFull(
+		"José Müa <jose@gopherpit.com>",
+		[]string{"Ünal <unal@gopherpit.com>", `"Zoë, Q." <zoe@gopherpit.com>`},
+		[]string{"Renée <renee@gopherpit.com>", "support@gopherpit.com"},
+		nil,
+		subject,
+		"test body",
+	); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	m := recorder.Message()
+	header, _, _ := strings.Cut(string(m.Data), "\r\n\r\n")
+	words := regexp.MustCompile(`=\?[^?]+\?[bBqQ]\?[^?]*\?=`).FindAllString(header, -1)
+	if len(words) == 0 {
+		t.Fatalf("no encoded-words in header %s", header)
+	}
+	for _, w := range words {
+		if len(w) > 75 {
+			t.Errorf("encoded-word longer than 75 characters: %q", w)
+		}
+		if strings.ContainsAny(w, "<@>") {
+			t.Errorf("addr-spec in encoded-word %q", w)
+		}
+	}
+
+	dec := new(mime.WordDecoder)
+	for field, want := range map[string]string{
+		"Subject": subject,
+		"From":    "José Müa <jose@gopherpit.com>",
+		"To":      "Ünal <unal@gopherpit.com>, Zoë, Q. <zoe@gopherpit.com>",
+		"Cc":      "Renée <renee@gopherpit.com>, support@gopherpit.com",
+	} {
+		got, err := dec.DecodeHeader(m.Header.Get(field))
+		if err != nil {
+			t.Fatalf("decode %s: %s", field, err)
+		}
+		if got != want {
+			t.Errorf("header %s: got %q, expected %q", field, got, want)
+		}
+	}
+	if m.From.Name != "José Müa" || m.From.Address != "jose@gopherpit.com" {
+		t.Errorf("unexpected From address %v", m.From)
+	}
+	if len(m.To) != 2 || m.To[1].Name != "Zoë, Q." || m.To[1].Address != "zoe@gopherpit.com" {
+		t.Errorf("unexpected To addresses %v", m.To)
+	}
+}
+
+func TestServiceNotifyAuthenticationResults(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost:        "localhost",
+		SMTPPort:        recorder.Port,
+		NotifyAddresses: []string{"operations@gopherpit.com"},
+		DefaultFrom:     "noreply@gopherpit.com",
+	}
+
+	results := "mx.gopherpit.com; spf=pass smtp.mailfrom=example.com; dkim=pass header.d=example.com; dmarc=pass header.from=example.com"
+	spf := "pass (mx.gopherpit.com: domain of alerts@example.com designates 192.0.2.1 as permitted sender) client-ip=192.0.2.1; envelope-from=alerts@example.com;"
+	if err := service.NotifyWithHeaders("test subject", "test body", map[string][]string{
+		"Authentication-Results": {results},
+		"Received-SPF":           {spf},
+	}); err != nil {
+		t.Fatalf("notify: %s", err)
+	}
+
+	got := recorder.Message().Header.Get("Authentication-Results")
+	if got != results {
+		t.Errorf("authentication results: expected %q, got %q", results, got)
+	}
+	got = recorder.Message().Header.Get("Received-SPF")
+	if got != spf {
+		t.Errorf("received spf: expected %q, got %q", spf, got)
+	}
+}
+
+func TestServiceNotifyDefaultBody(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost:          "localhost",
+		SMTPPort:          recorder.Port,
+		NotifyAddresses:   []string{"operations@gopherpit.com"},
+		DefaultFrom:       "noreply@gopherpit.com",
+		NotifyDefaultBody: "No details provided.",
+	}
+
+	if err := service.Notify("test subject", ""); err != nil {
+		t.Fatalf("notify: %s", err)
+	}
+	if want := "No details provided.\r\n"; recorder.Message().Body != want {
+		t.Errorf(`message body: expected "%v", got "%v"`, want, recorder.Message().Body)
+	}
+
+	if err := service.Notify("test subject", "test body"); err != nil {
+		t.Fatalf("notify: %s", err)
+	}
+	if want := "test body\r\n"; recorder.Message().Body != want {
+		t.Errorf(`message body: expected "%v", got "%v"`, want, recorder.Message().Body)
+	}
+
+	if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", ""); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+	if want := "\r\n"; recorder.Message().Body != want {
+		t.Errorf(`message body: expected "%v", got "%v"`, want, recorder.Message().Body)
+	}
+}
+
+func TestServiceAllowedEnvelopeFrom(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		from    string
+		headers map[string][]string
+		wantErr error
+	}{
+		{
+			name: "allowed",
+			from: "Gopher <Gopher@GopherPit.com>",
+		},
+		{
+			name:    "not allowed",
+			from:    "marketing@gopherpit.com",
+			wantErr: ErrEnvelopeFromNotAllowed,
+		},
+		{
+			name:    "allowed sender",
+			from:    "marketing@gopherpit.com",
+			headers: map[string][]string{"Sender": {"gopher@gopherpit.com"}},
+		},
+		{
+			name:    "not allowed sender",
+			from:    "gopher@gopherpit.com",
+			headers: map[string][]string{"Sender": {"marketing@gopherpit.com"}},
+			wantErr: ErrEnvelopeFromNotAllowed,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder.SetMessage(nil)
+
+			service := Service{
+				SMTPHost:            "localhost",
+				SMTPPort:            recorder.Port,
+				AllowedEnvelopeFrom: []string{"gopher@gopherpit.com", "noreply@gopherpit.com"},
+			}
+
+			err := service.SendEmailWithHeaders(tc.from, []string{"support@gopherpit.com"}, "test subject", "test body", tc.headers)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if sent := recorder.Message() != nil; sent != (tc.wantErr == nil) {
+				t.Errorf("expected message sent %v, got %v", tc.wantErr == nil, sent)
+			}
+		})
+	}
+}
+
+func TestServiceMaxSubjectLength(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		max     int
+		subject string
+		want    string
+	}{
+		{
+			name:    "not set",
+			subject: strings.Repeat("Здраво ", 10),
+			want:    strings.Repeat("Здраво ", 10),
+		},
+		{
+			name:    "shorter",
+			max:     10,
+			subject: "Здраво",
+			want:    "Здраво",
+		},
+		{
+			name:    "exact",
+			max:     6,
+			subject: "Здраво",
+			want:    "Здраво",
+		},
+		{
+			name:    "longer",
+			max:     10,
+			subject: strings.Repeat("Здраво ", 1000),
+			want:    "Здраво Зд…",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			service := Service{
+				SMTPHost:         "localhost",
+				SMTPPort:         recorder.Port,
+				MaxSubjectLength: tc.max,
+			}
+
+			if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, tc.subject, "test body"); err != nil {
+				t.Fatalf("send email: %s", err)
+			}
+			if got := recorder.Message().Subject; got != tc.want {
+				t.Errorf(`message subject: expected "%s", got "%s"`, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestServiceNotifyInvalidDefaultFrom(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	for _, from := range []string{"", "noreply", "noreply@gopherpit.com>"} {
+		service := Service{
+			SMTPHost:        "localhost",
+			SMTPPort:        recorder.Port,
+			NotifyAddresses: []string{"operations@gopherpit.com"},
+			DefaultFrom:     from,
+		}
+
+		err := service.Notify("test subject", "test body")
+		if !errors.Is(err, ErrInvalidDefaultFrom) {
+			t.Errorf("%q: expected error %v, got %v", from, ErrInvalidDefaultFrom, err)
+		}
+	}
+	if len(recorder.Commands()) != 0 {
+		t.Errorf("expected no smtp commands, got %q", recorder.Commands())
+	}
+}
+
+func TestServiceRecipientForwarded(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+	recorder.SetReply("RCPT", "251 User not local; will forward")
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	to := []string{"support@gopherpit.com", "contact@gopherpit.com"}
+	if err := service.SendEmail("gopher@gopherpit.com", to, "test subject", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	if recorder.Message() == nil {
+		t.Fatal("message not recorded")
+	}
+	if got := len(recorder.Message().To); got != len(to) {
+		t.Errorf("expected %v recipients, got %v", len(to), got)
+	}
+}
+
+func TestServiceDefaultFromName(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	to := []string{"support@gopherpit.com"}
+
+	for _, tc := range []struct {
+		name            string
+		defaultFromName string
+		from            string
+		wantName        string
+		wantAddress     string
+	}{
+		{
+			name:            "bare address",
+			defaultFromName: "GopherPit",
+			from:            "noreply@gopherpit.com",
+			wantName:        "GopherPit",
+		},
+		{
+			name:            "encoded name",
+			defaultFromName: "Гофер Пит",
+			from:            "noreply@gopherpit.com",
+			wantName:        "Гофер Пит",
+		},
+		{
+			name:            "existing name",
+			defaultFromName: "GopherPit",
+			from:            `"Gopher" <gopher@gopherpit.com>`,
+			wantName:        "Gopher",
+		},
+		{
+			name:            "idn domain",
+			defaultFromName: "GopherPit",
+			from:            "noreply@exämple.de",
+			wantName:        "GopherPit",
+			wantAddress:     "noreply@xn--exmple-cua.de",
+		},
+		{
+			name: "no default name",
+			from: "noreply@gopherpit.com",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			service := Service{
+				SMTPHost:        "localhost",
+				SMTPPort:        recorder.Port,
+				DefaultFromName: tc.defaultFromName,
+			}
+
+			if err := service.SendEmail(tc.from, to, "test subject", "test body"); err != nil {
+				t.Fatalf("send email: %s", err)
+			}
+
+			recordedFrom := recorder.Message().From
+			if recordedFrom.Name != tc.wantName {
+				t.Errorf("message from name: expected %q, got %q", tc.wantName, recordedFrom.Name)
+			}
+			wantAddress := tc.wantAddress
+			if wantAddress == "" {
+				wantAddress = addressSpec(tc.from)
+			}
+			if recordedFrom.Address != wantAddress {
+				t.Errorf("message from address: expected %q, got %q", wantAddress, recordedFrom.Address)
+			}
+		})
+	}
+}
+
+func TestServiceDefaultReplyTo(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost:        "localhost",
+		SMTPPort:        recorder.Port,
+		NotifyAddresses: []string{"operations@gopherpit.com"},
+		DefaultFrom:     "noreply@gopherpit.com",
+		DefaultFromName: "GopherPit Alerts",
+		DefaultReplyTo:  "Operations <operations@gopherpit.com>",
+	}
+
+	for _, tc := range []struct {
+		name    string
+		headers map[string][]string
+		want    string
+	}{
+		{
+			name: "default",
+			want: `"Operations" <operations@gopherpit.com>`,
+		},
+		{
+			name: "override",
+			headers: map[string][]string{
+				"Reply-To": {"support@gopherpit.com"},
+			},
+			want: "<support@gopherpit.com>",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := service.NotifyWithHeaders("test subject", "test body", tc.headers); err != nil {
+				t.Fatalf("notify: %s", err)
+			}
+
+			m := recorder.Message()
+			if got := m.From.String(); got != `"GopherPit Alerts" <noreply@gopherpit.com>` {
+				t.Errorf("unexpected From address %s", got)
+			}
+			if len(m.ReplyTo) != 1 || m.ReplyTo[0].String() != tc.want {
+				t.Errorf("got Reply-To addresses %v, expected %s", m.ReplyTo, tc.want)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		service := service
+		service.DefaultReplyTo = "operations at gopherpit.com"
+		if err := service.Notify("test subject", "test body"); !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("expected error %v, got %v", ErrInvalidAddress, err)
+		}
+	})
+}
+
+func TestServiceSendHTMLEmail(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	// A line that is longer than the 998 octets limit of RFC 5322.
+	long := strings.Repeat("Grüße from the gopher. ", 100)
+	html := "<h1>Hello</h1><p>" + long + "</p>"
+
+	if err := service.SendHTMLEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", html); err != nil {
+		t.Fatalf("send html email: %s", err)
+	}
+
+	m := recorder.Message()
+	for i, line := range strings.Split(m.Body, "\r\n") {
+		if len(line) > 998 {
+			t.Errorf("line %v: length %v exceeds 998 octets", i, len(line))
+		}
+	}
+	checkAlternativeParts(t, m, HTMLToText(html), html)
+}
+
+func TestServiceSendAlternative(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	text := "Hello, gopher!\r\n\r\nSee you at https://gopherpit.com.\r\n"
+	html := "<p>Hello, <b>gopher</b>!</p><p>See you at <a href=\"https://gopherpit.com\">GopherPit</a>.</p>"
+
+	if err := service.SendAlternative("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", text, html); err != nil {
+		t.Fatalf("send alternative: %s", err)
+	}
+
+	checkAlternativeParts(t, recorder.Message(), text, html)
+}
+
+// checkAlternativeParts validates that the message is multipart/alternative
+// with exactly one text/plain and one text/html part, in that order.
+func checkAlternativeParts(t *testing.T, m *smtpMessage, text, html string) {
+	t.Helper()
+
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parse content type: %s", err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("expected multipart/alternative media type, got %s", mediaType)
+	}
+
+	r := multipart.NewReader(strings.NewReader(m.Body), params["boundary"])
+	for i, want := range []struct {
+		mediaType string
+		body      string
+	}{
+		{mediaType: "text/plain", body: text},
+		{mediaType: "text/html", body: html},
+	} {
+		p, err := r.NextPart()
+		if err != nil {
+			t.Fatalf("part %v: %s", i, err)
+		}
+		mediaType, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatalf("part %v: parse content type: %s", i, err)
+		}
+		if mediaType != want.mediaType {
+			t.Errorf("part %v: expected media type %s, got %s", i, want.mediaType, mediaType)
+		}
+		if params["charset"] != "UTF-8" {
+			t.Errorf("part %v: expected charset UTF-8, got %s", i, params["charset"])
+		}
+		var pr io.Reader = p
+		if p.Header.Get("Content-Transfer-Encoding") == "base64" {
+			pr = base64.NewDecoder(base64.StdEncoding, p)
+		}
+		body, err := ioutil.ReadAll(pr)
+		if err != nil {
+			t.Fatalf("part %v: read body: %s", i, err)
+		}
+		if string(body) != want.body {
+			t.Errorf(`part %v body: expected "%s", got "%s"`, i, want.body, body)
+		}
+	}
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Errorf("expected no more parts, got %v", err)
+	}
+}
+
+func TestServiceSendDigest(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	subjects := []string{"First alert", "Second alert"}
+	messages := make([][]byte, 0, len(subjects))
+	for _, subject := range subjects {
+		messages = append(messages, []byte("From: monitor@gopherpit.com\r\nTo: operations@gopherpit.com\r\nSubject: "+subject+"\r\n\r\n"+subject+" body\r\n"))
+	}
+
+	if err := service.SendDigest("noreply@gopherpit.com", []string{"operations@gopherpit.com"}, "Daily digest", messages); err != nil {
+		t.Fatalf("send digest: %s", err)
+	}
+
+	m := recorder.Message()
+	if m.Subject != "Daily digest" {
+		t.Errorf(`message subject: expected "%s", got "%s"`, "Daily digest", m.Subject)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parse content type: %s", err)
+	}
+	if mediaType != "multipart/digest" {
+		t.Fatalf("expected multipart/digest media type, got %s", mediaType)
+	}
+
+	r := multipart.NewReader(strings.NewReader(m.Body), params["boundary"])
+	for i, subject := range subjects {
+		p, err := r.NextPart()
+		if err != nil {
+			t.Fatalf("part %v: %s", i, err)
+		}
+		if ct := p.Header.Get("Content-Type"); ct != "" {
+			t.Errorf("part %v: expected default content type, got %s", i, ct)
+		}
+		pm, err := mail.ReadMessage(p)
+		if err != nil {
+			t.Fatalf("part %v: read message: %s", i, err)
+		}
+		if got := pm.Header.Get("Subject"); got != subject {
+			t.Errorf(`part %v subject: expected "%s", got "%s"`, i, subject, got)
+		}
+		body, err := ioutil.ReadAll(pm.Body)
+		if err != nil {
+			t.Fatalf("part %v: read body: %s", i, err)
+		}
+		if want := subject + " body\r\n"; string(body) != want {
+			t.Errorf(`part %v body: expected "%s", got "%s"`, i, want, body)
+		}
+	}
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Errorf("expected no more parts, got %v", err)
+	}
+}
+
+func TestServiceEightBit(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		extensions   []string
+		body         string
+		wantMail     string
+		wantEncoding string
+	}{
+		{
+			name:         "8bitmime",
+			extensions:   []string{"8BITMIME"},
+			body:         "Grüße",
+			wantMail:     "MAIL FROM:<gopher@gopherpit.com> BODY=8BITMIME",
+			wantEncoding: "8bit",
+		},
+		{
+			name:         "no 8bitmime",
+			body:         "Grüße",
+			wantMail:     "MAIL FROM:<gopher@gopherpit.com>",
+			wantEncoding: "quoted-printable",
+		},
+		{
+			name:         "long line",
+			extensions:   []string{"8BITMIME"},
+			body:         "Grüße\r\n" + strings.Repeat("a", 999) + "\r\n",
+			wantMail:     "MAIL FROM:<gopher@gopherpit.com> BODY=8BITMIME",
+			wantEncoding: "quoted-printable",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder, err := newSMTPRecorder(t, tc.extensions...)
+			if err != nil {
+				t.Fatalf("smtp listen: %s", err)
+			}
+
+			service := Service{
+				SMTPHost: "localhost",
+				SMTPPort: recorder.Port,
+				Encoding: EightBit,
+			}
+
+			if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", tc.body); err != nil {
+				t.Fatalf("send email: %s", err)
+			}
+
+			var mail string
+			for _, c := range recorder.Commands() {
+				if strings.HasPrefix(c, "MAIL ") {
+					mail = c
+				}
+			}
+			if mail != tc.wantMail {
+				t.Errorf("got %q, expected %q", mail, tc.wantMail)
+			}
+			m := recorder.Message()
+			if got := m.Header.Get("Content-Transfer-Encoding"); got != tc.wantEncoding {
+				t.Errorf("encoding: expected %s, got %s", tc.wantEncoding, got)
+			}
+			body := m.Body
+			if tc.wantEncoding == "quoted-printable" {
+				b, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(m.Body)))
+				if err != nil {
+					t.Fatalf("decode body: %s", err)
+				}
+				body = string(b)
+			}
+			if strings.TrimSuffix(body, "\r\n") != strings.TrimSuffix(tc.body, "\r\n") {
+				t.Errorf("body: expected %q, got %q", tc.body, body)
+			}
+		})
+	}
+}
+
+func TestServiceCharset(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		charset  string
+		body     string
+		want     string
+		wantBody string
+	}{
+		{
+			name:     "ascii",
+			body:     "Hello",
+			want:     "UTF-8",
+			wantBody: "Hello\r\n",
+		},
+		{
+			name:     "utf-8",
+			body:     "Grüße",
+			want:     "UTF-8",
+			wantBody: "Gr=C3=BC=C3=9Fe\r\n",
+		},
+		{
+			name:     "latin-1",
+			body:     "Gr\xfc\xdfe",
+			want:     "ISO-8859-1",
+			wantBody: "Gr=FC=DFe\r\n",
+		},
+		{
+			name:     "windows-1252",
+			body:     "\x93Gr\xfc\xdfe\x94",
+			want:     "Windows-1252",
+			wantBody: "=93Gr=FC=DFe=94\r\n",
+		},
+		{
+			name:     "explicit",
+			charset:  "ISO-8859-15",
+			body:     "Gr\xfc\xdfe \xa4",
+			want:     "ISO-8859-15",
+			wantBody: "Gr=FC=DFe =A4\r\n",
+		},
+		{
+			name:     "transcoded",
+			charset:  "ISO-8859-15",
+			body:     "Grüße €",
+			want:     "ISO-8859-15",
+			wantBody: "Gr=FC=DFe =A4\r\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			service := Service{
+				SMTPHost: "localhost",
+				SMTPPort: recorder.Port,
+				Charset:  tc.charset,
+				Encoding: QuotedPrintable,
+			}
+
+			if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "Grüße", tc.body); err != nil {
+				t.Fatalf("send email: %s", err)
+			}
+
+			m := recorder.Message()
+			_, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatalf("parse content type: %s", err)
+			}
+			if params["charset"] != tc.want {
+				t.Errorf("charset: expected %s, got %s", tc.want, params["charset"])
+			}
+			if m.Body != tc.wantBody {
+				t.Errorf(`message body: expected "%v", got "%v"`, tc.wantBody, m.Body)
+			}
+			if want := "Grüße"; m.Subject != want {
+				t.Errorf(`message subject: expected "%s", got "%s"`, want, m.Subject)
+			}
+		})
+	}
+}
+
+func TestServiceCharsetError(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		charset string
+		body    string
+		want    string
+	}{
+		{
+			name:    "unsupported",
+			charset: "ISO-8859-42",
+			body:    "Hello",
+			want:    `email: unsupported charset "ISO-8859-42"`,
+		},
+		{
+			name:    "not representable",
+			charset: "ISO-8859-1",
+			body:    "Привет",
+			want:    "email: body can not be encoded in charset ISO-8859-1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			service := Service{
+				SMTPHost: "localhost",
+				SMTPPort: recorder.Port,
+				Charset:  tc.charset,
+			}
+
+			err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", tc.body)
+			if err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+				t.Errorf("expected error %q, got %v", tc.want, err)
+			}
+		})
+	}
+	if commands := recorder.Commands(); len(commands) != 0 {
+		t.Errorf("expected no smtp commands, got %q", commands)
+	}
+}
+
+func TestServiceEncoding(t *testing.T) {
+	recorder, err := newSMTPRecorder(t, "8BITMIME")
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		encoding Encoding
+		body     string
+		want     string
+		wantBody string
+	}{
+		{
+			name:     "ascii",
+			body:     "Hello",
+			want:     "quoted-printable",
+			wantBody: "Hello\r\n",
+		},
+		{
+			name:     "mostly ascii",
+			body:     "Hello, Grüße",
+			want:     "quoted-printable",
+			wantBody: "Hello, Gr=C3=BC=C3=9Fe\r\n",
+		},
+		{
+			name:     "mostly non-ascii",
+			body:     "Здраво",
+			want:     "base64",
+			wantBody: "0JfQtNGA0LDQstC+\r\n",
+		},
+		{
+			name:     "forced quoted-printable",
+			encoding: QuotedPrintable,
+			body:     "Здраво",
+			want:     "quoted-printable",
+			wantBody: "=D0=97=D0=B4=D1=80=D0=B0=D0=B2=D0=BE\r\n",
+		},
+		{
+			name:     "forced base64",
+			encoding: Base64,
+			body:     "Hello",
+			want:     "base64",
+			wantBody: "SGVsbG8=\r\n",
+		},
+		{
+			name:     "8bit",
+			encoding: EightBit,
+			body:     "Hello, Grüße",
+			want:     "8bit",
+			wantBody: "Hello, Grüße\r\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			service := Service{
+				SMTPHost: "localhost",
+				SMTPPort: recorder.Port,
+				Encoding: tc.encoding,
+			}
+
+			if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", tc.body); err != nil {
+				t.Fatalf("send email: %s", err)
+			}
+
+			m := recorder.Message()
+			if got := m.Header.Get("Content-Transfer-Encoding"); got != tc.want {
+				t.Errorf("encoding: expected %s, got %s", tc.want, got)
+			}
+			if m.Body != tc.wantBody {
+				t.Errorf(`message body: expected "%v", got "%v"`, tc.wantBody, m.Body)
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: recorder.Port,
+			Encoding: "7bit",
+		}
+
+		if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err == nil {
+			t.Error("expected error for unsupported encoding")
+		}
+	})
+}
+
+func TestServiceSendEmailFull(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	if err := service.SendEmailFull(
+		"gopher@gopherpit.com",
+		[]string{"support@gopherpit.com"},
+		[]string{"Operations <operations@gopherpit.com>"},
+		[]string{"audit@gopherpit.com", "support@gopherpit.com"},
+		"test subject", "test body",
+	); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	var rcpt []string
+	for _, c := range recorder.Commands() {
+		if strings.HasPrefix(c, "RCPT ") {
+			rcpt = append(rcpt, c)
+		}
+	}
+	want := []string{
+		"RCPT TO:<support@gopherpit.com>",
+		"RCPT TO:<operations@gopherpit.com>",
+		"RCPT TO:<audit@gopherpit.com>",
+	}
+	if strings.Join(rcpt, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected recipients %q, got %q", want, rcpt)
+	}
+
+	m := recorder.Message()
+	if got := m.Header.Get("Cc"); got != "Operations <operations@gopherpit.com>" {
+		t.Errorf("expected cc header, got %q", got)
+	}
+	if _, ok := m.Header["Bcc"]; ok {
+		t.Errorf("expected no bcc header, got %q", m.Header["Bcc"])
+	}
+	for k, v := range m.Header {
+		if strings.Contains(strings.Join(v, ","), "audit@gopherpit.com") {
+			t.Errorf("bcc recipient found in header %s", k)
+		}
+	}
+}
+
+func TestServiceSendRawWithEnvelope(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+		Hostname: "mail.gopherpit.com",
+		MessageIDFunc: func(string) string {
+			return "generated@gopherpit.com"
+		},
+	}
+
+	raw := "From: Gopher <gopher@gopherpit.com>\n" +
+		"To: support@gopherpit.com\n" +
+		"Subject: raw message\n" +
+		"\n" +
+		"First line\r\n" +
+		".leading dot\n" +
+		"Last line\n"
+
+	if err := service.SendRawWithEnvelope(context.Background(), "bounces@gopherpit.com", []string{"support@gopherpit.com", "Audit <audit@gopherpit.com>"}, []byte(raw)); err != nil {
+		t.Fatalf("send raw: %s", err)
+	}
+
+	var envelope []string
+	for _, c := range recorder.Commands() {
+		if strings.HasPrefix(c, "MAIL ") || strings.HasPrefix(c, "RCPT ") {
+			envelope = append(envelope, c)
+		}
+	}
+	wantEnvelope := []string{
+		"MAIL FROM:<bounces@gopherpit.com>",
+		"RCPT TO:<support@gopherpit.com>",
+		"RCPT TO:<audit@gopherpit.com>",
+	}
+	if strings.Join(envelope, "\n") != strings.Join(wantEnvelope, "\n") {
+		t.Errorf("expected envelope %q, got %q", wantEnvelope, envelope)
+	}
+
+	want := strings.ReplaceAll(strings.ReplaceAll(raw, "\r\n", "\n"), "\n", "\r\n")
+	if got := string(recorder.Message().Data); got != want {
+		t.Errorf("expected data %q, got %q", want, got)
+	}
+
+	if err := service.SendRawWithEnvelope(context.Background(), "bounces@gopherpit.com", nil, []byte(raw)); !errors.Is(err, ErrNoRecipients) {
+		t.Errorf("expected error %v, got %v", ErrNoRecipients, err)
+	}
+}
+
+func TestServiceSendRaw(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	raw := "From: gopher@gopherpit.com\nTo: support@gopherpit.com\nSubject: test subject\n\n.\n..two dots\n"
+	if err := service.SendRaw("gopher@gopherpit.com", []string{"support@gopherpit.com"}, []byte(raw)); err != nil {
+		t.Fatalf("send raw: %s", err)
+	}
+
+	if want, got := strings.ReplaceAll(raw, "\n", "\r\n"), string(recorder.Message().Data); got != want {
+		t.Errorf("expected data %q, got %q", want, got)
+	}
+}
+
+func TestServiceSendRawWithEnvelopeNoTrailingNewline(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	raw := "From: gopher@gopherpit.com\r\nTo: support@gopherpit.com\r\nSubject: test subject\r\n\r\nlast line without newline."
+	if err := service.SendRawWithEnvelope(context.Background(), "gopher@gopherpit.com", []string{"support@gopherpit.com"}, []byte(raw)); err != nil {
+		t.Fatalf("send raw: %s", err)
+	}
+
+	if want, got := raw+"\r\n", string(recorder.Message().Data); got != want {
+		t.Errorf("expected data %q, got %q", want, got)
+	}
+}
+
+func TestServiceSendRawWithEnvelopeCanceled(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = service.SendRawWithEnvelope(ctx, "gopher@gopherpit.com", []string{"support@gopherpit.com"}, []byte("Subject: test\r\n\r\ntest body\r\n"))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error %v, got %v", context.Canceled, err)
+	}
+	if recorder.Message() != nil {
+		t.Errorf("expected no message, but message %#v has been recorded", recorder.Message())
+	}
+}
+
+func TestServiceEnvelopeNormalization(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		lowercase    bool
+		wantEnvelope []string
+	}{
+		{
+			name: "domain",
+			wantEnvelope: []string{
+				"MAIL FROM:<Gopher@gopherpit.com>",
+				"RCPT TO:<Support@gopherpit.com>",
+				"RCPT TO:<support@gopherpit.com>",
+			},
+		},
+		{
+			name:      "local part",
+			lowercase: true,
+			wantEnvelope: []string{
+				"MAIL FROM:<gopher@gopherpit.com>",
+				"RCPT TO:<support@gopherpit.com>",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder, err := newSMTPRecorder(t)
+			if err != nil {
+				t.Fatalf("smtp listen: %s", err)
+			}
+
+			service := Service{
+				SMTPHost:           "localhost",
+				SMTPPort:           recorder.Port,
+				LowercaseLocalPart: tc.lowercase,
+			}
+
+			if err := service.SendEmailFull(
+				"Gopher@GopherPit.com",
+				[]string{"Support@GopherPit.COM", "Support@gopherpit.com"},
+				[]string{"support@GOPHERPIT.com"},
+				nil,
+				"test subject", "test body",
+			); err != nil {
+				t.Fatalf("send email: %s", err)
+			}
+
+			var envelope []string
+			for _, c := range recorder.Commands() {
+				if strings.HasPrefix(c, "MAIL ") || strings.HasPrefix(c, "RCPT ") {
+					envelope = append(envelope, c)
+				}
+			}
+			if strings.Join(envelope, "\n") != strings.Join(tc.wantEnvelope, "\n") {
+				t.Errorf("expected envelope %q, got %q", tc.wantEnvelope, envelope)
+			}
+		})
+	}
+}
+
+func TestServiceEnvelopeDeduplication(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		plusTags  bool
+		wantRcpts []string
+	}{
+		{
+			name: "duplicates",
+			wantRcpts: []string{
+				"RCPT TO:<support@gopherpit.com>",
+				"RCPT TO:<support+billing@gopherpit.com>",
+				"RCPT TO:<Support+Billing@gopherpit.com>",
+				"RCPT TO:<sales@gopherpit.com>",
+				"RCPT TO:<sales+archive@gopherpit.com>",
+			},
+		},
+		{
+			name:     "plus tags",
+			plusTags: true,
+			wantRcpts: []string{
+				"RCPT TO:<support@gopherpit.com>",
+				"RCPT TO:<Support+Billing@gopherpit.com>",
+				"RCPT TO:<sales@gopherpit.com>",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder, err := newSMTPRecorder(t)
+			if err != nil {
+				t.Fatalf("smtp listen: %s", err)
+			}
+
+			service := Service{
+				SMTPHost:            "localhost",
+				SMTPPort:            recorder.Port,
+				DeduplicatePlusTags: tc.plusTags,
+			}
+
+			to := []string{"support@gopherpit.com", "support+billing@gopherpit.com"}
+			cc := []string{"Support <support@GopherPit.com>", "Support+Billing@gopherpit.com", "sales@gopherpit.com"}
+			bcc := []string{"sales+archive@gopherpit.com", "support@gopherpit.com"}
+			if err := service.SendEmailFull("gopher@gopherpit.com", to, cc, bcc, "test subject", "test body"); err != nil {
+				t.Fatalf("send email: %s", err)
+			}
+
+			var rcpts []string
+			for _, c := range recorder.Commands() {
+				if strings.HasPrefix(c, "RCPT ") {
+					rcpts = append(rcpts, c)
+				}
+			}
+			if strings.Join(rcpts, "\n") != strings.Join(tc.wantRcpts, "\n") {
+				t.Errorf("expected recipients %q, got %q", tc.wantRcpts, rcpts)
+			}
+
+			m := recorder.Message()
+			if got, want := m.Header.Get("To"), "support@gopherpit.com, support+billing@gopherpit.com"; got != want {
+				t.Errorf("got To header %q, expected %q", got, want)
+			}
+			if got, want := m.Header.Get("Cc"), "Support <support@GopherPit.com>, Support+Billing@gopherpit.com, sales@gopherpit.com"; got != want {
+				t.Errorf("got Cc header %q, expected %q", got, want)
+			}
+		})
+	}
+}
+
+func TestServiceSendEmailWithReadReceipt(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	from := "gopher@gopherpit.com"
+	to := []string{"support@gopherpit.com"}
+
+	t.Run("Valid", func(t *testing.T) {
+		if err := service.SendEmailWithReadReceipt(from, to, "test subject", "test body", `"Gopher" <receipts@gopherpit.com>`); err != nil {
+			t.Fatalf("send email: %s", err)
+		}
+
+		for _, h := range []string{"Disposition-Notification-To", "Return-Receipt-To"} {
+			list, err := recorder.Message().Header.AddressList(h)
+			if err != nil {
+				t.Fatalf("%s: %s", h, err)
+			}
+			if len(list) != 1 || list[0].Address != "receipts@gopherpit.com" || list[0].Name != "Gopher" {
+				t.Errorf("%s: unexpected value %v", h, list)
+			}
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		recorder.SetMessage(nil)
+		if err := service.SendEmailWithReadReceipt(from, to, "test subject", "test body", "receipts"); err == nil {
+			t.Error("expected error for invalid receipt address")
+		}
+		if recorder.Message() != nil {
+			t.Errorf("expected no message, but message %#v has been recorded", recorder.Message())
+		}
+	})
+}
+
+func TestServiceEnabled(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	var enabled int32 = 1
+	service := Service{
+		SMTPHost:        "localhost",
+		SMTPPort:        recorder.Port,
+		NotifyAddresses: []string{"operations@gopherpit.com"},
+		DefaultFrom:     "noreply@gopherpit.com",
+		Enabled: func() bool {
+			return atomic.LoadInt32(&enabled) == 1
+		},
+	}
+
+	if err := service.Notify("test subject", "test body"); err != nil {
+		t.Fatalf("notify: %s", err)
+	}
+	if recorder.Message() == nil {
+		t.Fatal("expected message to be recorded")
+	}
+
+	atomic.StoreInt32(&enabled, 0)
+	recorder.SetMessage(nil)
+	if err := service.Notify("test subject", "test body"); err != ErrSendingDisabled {
+		t.Errorf("expected error %v, got %v", ErrSendingDisabled, err)
+	}
+	if err := service.SendDigest("noreply@gopherpit.com", []string{"operations@gopherpit.com"}, "test subject", nil); err != ErrSendingDisabled {
+		t.Errorf("expected error %v, got %v", ErrSendingDisabled, err)
+	}
+
+	service.DisabledNoOp = true
+	if err := service.Notify("test subject", "test body"); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if recorder.Message() != nil {
+		t.Errorf("expected no-op, but message %#v has been recorded", recorder.Message())
+	}
+
+	atomic.StoreInt32(&enabled, 1)
+	if err := service.Notify("test subject", "test body"); err != nil {
+		t.Fatalf("notify: %s", err)
+	}
+	if recorder.Message() == nil {
+		t.Error("expected message to be recorded")
+	}
+}
+
+func TestServiceRetry(t *testing.T) {
+	t.Run("temporary failure", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+		recorder.QueueReplies("RCPT", "450 Mailbox busy", "450 Mailbox busy")
+
+		stats := new(SendStats)
+		service := Service{
+			SMTPHost:      "localhost",
+			SMTPPort:      recorder.Port,
+			RetryAttempts: 3,
+			RetryBackoff:  time.Millisecond,
+			Stats:         stats,
+		}
+
+		if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test", "test body"); err != nil {
+			t.Fatal(err)
+		}
+		if recorder.Message() == nil {
+			t.Error("expected message, but none has been recorded")
+		}
+		got := stats.Snapshot()
+		if got.Sent != 1 || got.Failed != 0 || got.Retried != 2 {
+			t.Errorf("got stats %+v, expected 1 sent, 0 failed and 2 retried", got)
+		}
+	})
+
+	t.Run("attempts exhausted", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+		recorder.SetReply("RCPT", "450 Mailbox busy")
+
+		stats := new(SendStats)
+		service := Service{
+			SMTPHost:      "localhost",
+			SMTPPort:      recorder.Port,
+			RetryAttempts: 2,
+			RetryBackoff:  time.Millisecond,
+			Stats:         stats,
+		}
+
+		err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test", "test body")
+		var e *SendError
+		if !errors.As(err, &e) || e.Code != 450 {
+			t.Fatalf("expected SendError with code 450, got %v", err)
+		}
+		if got := stats.Snapshot().Retried; got != 2 {
+			t.Errorf("got %v retries, expected 2", got)
+		}
+	})
+
+	t.Run("permanent failure", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+		recorder.QueueReplies("RCPT", "550 No such user")
+
+		stats := new(SendStats)
+		service := Service{
+			SMTPHost:      "localhost",
+			SMTPPort:      recorder.Port,
+			RetryAttempts: 3,
+			RetryBackoff:  time.Millisecond,
+			Stats:         stats,
+		}
+
+		err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test", "test body")
+		var e *SendError
+		if !errors.As(err, &e) || e.Code != 550 {
+			t.Fatalf("expected SendError with code 550, got %v", err)
+		}
+		if got := stats.Snapshot().Retried; got != 0 {
+			t.Errorf("got %v retries, expected none", got)
+		}
+		if recorder.Message() != nil {
+			t.Errorf("expected no message, but message %#v has been recorded", recorder.Message())
+		}
+	})
+
+	t.Run("context deadline", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+		recorder.SetReply("RCPT", "450 Mailbox busy")
+
+		service := Service{
+			SMTPHost:      "localhost",
+			SMTPPort:      recorder.Port,
+			RetryAttempts: 10,
+			RetryBackoff:  time.Hour,
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err = service.SendRawWithEnvelope(ctx, "gopher@gopherpit.com", []string{"support@gopherpit.com"}, []byte("From: gopher@gopherpit.com\r\nTo: support@gopherpit.com\r\nSubject: test\r\n\r\ntest body\r\n"))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected error %v, got %v", context.DeadlineExceeded, err)
+		}
+		if d := time.Since(start); d > 10*time.Second {
+			t.Errorf("retry took %s, expected to stop at the context deadline", d)
+		}
+	})
+}
+
+func TestServiceRateLimiter(t *testing.T) {
+	transport := new(MemoryTransport)
+	service := Service{
+		Transport:   transport,
+		RateLimiter: rate.NewLimiter(rate.Every(50*time.Millisecond), 1),
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+			t.Fatalf("send email: %s", err)
+		}
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("expected sending to be paced to at least 100ms, got %s", d)
+	}
+
+	service.RateLimiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+	service.RateLimiter.Allow()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err := service.SendRawWithEnvelope(ctx, "gopher@gopherpit.com", []string{"support@gopherpit.com"}, []byte("From: gopher@gopherpit.com\r\nTo: support@gopherpit.com\r\nSubject: test\r\n\r\ntest body\r\n"))
+	if err == nil {
+		t.Fatal("expected rate limiter error")
+	}
+	if got := len(transport.Messages()); got != 3 {
+		t.Errorf("got %v messages, expected 3", got)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email_test
+
+import (
+	"fmt"
+
+	"resenje.org/email"
+)
+
+func ExampleMemorySender() {
+	sender := &email.MemorySender{
+		NotifyAddresses: []string{"operations@gopherpit.com"},
+		DefaultFrom:     "noreply@gopherpit.com",
+		SubjectPrefix:   "[GopherPit] ",
+	}
+
+	notify(sender)
+
+	m := sender.LastMessage()
+	fmt.Println(m.From)
+	fmt.Println(m.Subject)
+	fmt.Println(len(sender.MessagesTo("Operations <operations@gopherpit.com>")))
+	// Output:
+	// noreply@gopherpit.com
+	// [GopherPit] Deployment finished
+	// 1
+}
+
+func notify(s email.Sender) {
+	if err := s.Notify("Deployment finished", "Version 1.2.3 is deployed."); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// SMTPServer is an SMTP server that is used when sending to the server
+// configured by Service fields fails.
+type SMTPServer struct {
+	// SMTP server host.
+	Host string
+	// SMTP server port.
+	Port int
+	// Username and password for SMTP server authentication.
+	Username string
+	Password string
+}
+
+// sendFallback sends the message content to Service.SMTPHost, and then to
+// Service.SMTPFallbackServers, until one of them accepts or permanently
+// rejects it. The error from the last server is returned.
+func (s Service) sendFallback(ctx context.Context, from string, to []string, content io.WriterTo, opts sendOptions) (n int64, err error) {
+	n, err = s.send(ctx, from, to, content, opts)
+	for _, server := range s.SMTPFallbackServers {
+		if err == nil || ctx.Err() != nil || isRejected(err) {
+			break
+		}
+		f := s
+		f.SMTPHost = server.Host
+		f.SMTPPort = server.Port
+		f.SMTPUsername = server.Username
+		f.SMTPPassword = server.Password
+		n, err = f.send(ctx, from, to, content, opts)
+		var e *SendError
+		if errors.As(err, &e) {
+			e.Address = f.address()
+		}
+	}
+	return n, err
+}
+
+// isRejected reports whether the error is a permanent rejection of the
+// message or its recipients, which would be rejected by other servers, too.
+func isRejected(err error) bool {
+	var e *SendError
+	if !errors.As(err, &e) {
+		return false
+	}
+	switch e.Stage {
+	case StageMailFrom, StageRcpt, StageData:
+	default:
+		return false
+	}
+	var smtpErr *SMTPError
+	return errors.As(err, &smtpErr) && smtpErr.Bounce() == HardBounce
+}
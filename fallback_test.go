@@ -0,0 +1,126 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestServiceFallbackServers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	closedPort := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	t.Run("connection error", func(t *testing.T) {
+		fallback, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+
+		service := Service{
+			SMTPHost: "127.0.0.1",
+			SMTPPort: closedPort,
+			SMTPFallbackServers: []SMTPServer{
+				{Host: "localhost", Port: fallback.Port},
+			},
+		}
+
+		if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+			t.Fatal(err)
+		}
+		if m := fallback.Message(); m == nil || m.Subject != "test subject" {
+			t.Errorf("expected message to be sent to the fallback server, got %#v", m)
+		}
+	})
+
+	t.Run("temporary error", func(t *testing.T) {
+		primary, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+		primary.SetReply("MAIL", "451 4.3.0 Try again later")
+		fallback, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: primary.Port,
+			SMTPFallbackServers: []SMTPServer{
+				{Host: "localhost", Port: fallback.Port},
+			},
+		}
+
+		if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+			t.Fatal(err)
+		}
+		if m := fallback.Message(); m == nil || m.Subject != "test subject" {
+			t.Errorf("expected message to be sent to the fallback server, got %#v", m)
+		}
+	})
+
+	t.Run("permanent rejection", func(t *testing.T) {
+		primary, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+		primary.SetReply("RCPT", "550 5.1.1 User unknown")
+		fallback, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: primary.Port,
+			SMTPFallbackServers: []SMTPServer{
+				{Host: "localhost", Port: fallback.Port},
+			},
+		}
+
+		err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+		var e *SendError
+		if !errors.As(err, &e) || e.Stage != StageRcpt {
+			t.Fatalf("expected SendError at stage %v, got %v", StageRcpt, err)
+		}
+		if len(fallback.Commands()) != 0 {
+			t.Errorf("expected no commands on the fallback server, got %q", fallback.Commands())
+		}
+	})
+
+	t.Run("all failed", func(t *testing.T) {
+		fallback, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+		fallback.SetReply("DATA", "452 4.3.1 Insufficient system storage")
+
+		service := Service{
+			SMTPHost: "127.0.0.1",
+			SMTPPort: closedPort,
+			SMTPFallbackServers: []SMTPServer{
+				{Host: "localhost", Port: fallback.Port},
+			},
+		}
+
+		err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+		var e *SendError
+		if !errors.As(err, &e) || e.Stage != StageData {
+			t.Fatalf("expected SendError at stage %v, got %v", StageData, err)
+		}
+		if want := "localhost:" + strconv.Itoa(fallback.Port); !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error %q to contain %q", err, want)
+		}
+	})
+}
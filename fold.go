@@ -0,0 +1,143 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// maxHeaderLineLength is the line length, excluding CRLF, that headers are
+// folded at, as recommended by RFC 5322.
+const maxHeaderLineLength = 78
+
+// foldedMessage writes the message with its header fields folded at
+// whitespace to lines of at most maxHeaderLineLength characters, where
+// possible. Headers of the message parts and the body are written unchanged.
+type foldedMessage struct {
+	io.WriterTo
+}
+
+func (m foldedMessage) WriteTo(w io.Writer) (int64, error) {
+	f := &headerFolder{w: w}
+	if _, err := m.WriterTo.WriteTo(f); err != nil {
+		return f.n, err
+	}
+	err := f.flush()
+	return f.n, err
+}
+
+// headerFolder is a writer that unfolds header fields written to it and folds
+// them again, until the empty line that separates the header from the body.
+type headerFolder struct {
+	w io.Writer
+	n int64
+	// Incomplete line.
+	buf []byte
+	// Unfolded header field that may continue on the next line.
+	field string
+	body  bool
+}
+
+func (f *headerFolder) Write(p []byte) (int, error) {
+	if f.body {
+		return f.write(p)
+	}
+	f.buf = append(f.buf, p...)
+	for !f.body {
+		i := bytes.IndexByte(f.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(bytes.TrimSuffix(f.buf[:i], []byte("\r")))
+		f.buf = f.buf[i+1:]
+		switch {
+		case line == "":
+			if err := f.writeField(); err != nil {
+				return 0, err
+			}
+			f.body = true
+			if _, err := f.write([]byte("\r\n")); err != nil {
+				return 0, err
+			}
+		case line[0] == ' ' || line[0] == '\t':
+			f.field += line
+		default:
+			if err := f.writeField(); err != nil {
+				return 0, err
+			}
+			f.field = line
+		}
+	}
+	if f.body && len(f.buf) > 0 {
+		buf := f.buf
+		f.buf = nil
+		if _, err := f.write(buf); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// writeField writes the pending header field.
+func (f *headerFolder) writeField() error {
+	if f.field == "" {
+		return nil
+	}
+	field := f.field
+	f.field = ""
+	_, err := f.write([]byte(foldHeader(field)))
+	return err
+}
+
+// flush writes the pending header field and any incomplete line.
+func (f *headerFolder) flush() error {
+	if err := f.writeField(); err != nil {
+		return err
+	}
+	if len(f.buf) > 0 {
+		buf := f.buf
+		f.buf = nil
+		if _, err := f.write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *headerFolder) write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.n += int64(n)
+	return n, err
+}
+
+// foldHeader returns the unfolded header field with CRLF and a whitespace
+// inserted before the whitespace that is the closest to the line length
+// limit, as defined in RFC 5322 section 2.2.3. Lines without whitespace are
+// not folded, and encoded-words, as defined in RFC 2047, are kept whole as
+// they do not contain whitespace.
+func foldHeader(field string) string {
+	var b strings.Builder
+	for len(field) > maxHeaderLineLength {
+		// The first character of a continuation line is whitespace that can
+		// not be folded before.
+		i := strings.LastIndexAny(field[1:maxHeaderLineLength+1], " \t") + 1
+		if i == 0 {
+			i = strings.IndexAny(field[maxHeaderLineLength:], " \t")
+			if i < 0 {
+				break
+			}
+			i += maxHeaderLineLength
+		}
+		b.WriteString(field[:i])
+		b.WriteString("\r\n")
+		field = field[i:]
+	}
+	b.WriteString(field)
+	b.WriteString("\r\n")
+	return b.String()
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"testing"
+)
+
+func TestFoldHeader(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	for _, tc := range []struct {
+		name  string
+		field string
+		want  string
+	}{
+		{
+			name:  "short",
+			field: "Subject: test subject",
+			want:  "Subject: test subject\r\n",
+		},
+		{
+			name:  "at whitespace before limit",
+			field: "Subject: " + strings.Repeat("gopher ", 15),
+			want:  "Subject: " + strings.Repeat("gopher ", 9) + "gopher\r\n " + strings.Repeat("gopher ", 4) + "gopher \r\n",
+		},
+		{
+			name:  "at whitespace after limit",
+			field: "X-Long: " + long + " tail",
+			want:  "X-Long:\r\n " + long + "\r\n tail\r\n",
+		},
+		{
+			name:  "no whitespace",
+			field: "X-Long:" + long,
+			want:  "X-Long:" + long + "\r\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := foldHeader(tc.field); got != tc.want {
+				t.Errorf("got %q, expected %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestServiceLongHeaders(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	subject := strings.Repeat("Новости о гоферах и их приключениях, ", 10)
+	to := make([]string, 50)
+	for i := range to {
+		to[i] = fmt.Sprintf("Gopher Number %d <gopher%d@gopherpit.com>", i, i)
+	}
+	if err := service.SendEmail("gopher@gopherpit.com", to, subject, "test body"); err != nil {
+		t.Fatalf("send: %s", err)
+	}
+
+	m := recorder.Message()
+	header, _, _ := strings.Cut(string(m.Data), "\r\n\r\n")
+	for _, line := range strings.Split(header, "\r\n") {
+		if len(line) > maxHeaderLineLength {
+			t.Errorf("header line longer than %v characters: %q", maxHeaderLineLength, line)
+		}
+		if strings.Contains(line, "Новости") {
+			t.Errorf("subject is not encoded: %q", line)
+		}
+	}
+	got, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != subject {
+		t.Errorf("got subject %q, expected %q", got, subject)
+	}
+	if len(m.To) != len(to) {
+		t.Fatalf("got %v To addresses, expected %v", len(m.To), len(to))
+	}
+	for i, a := range m.To {
+		if a.String() != fmt.Sprintf(`"Gopher Number %d" <gopher%d@gopherpit.com>`, i, i) {
+			t.Errorf("unexpected To address %v", a)
+		}
+	}
+}
@@ -1,8 +1,13 @@
 module resenje.org/email
 
-go 1.13
+go 1.22
 
 require (
-	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
+	golang.org/x/crypto v0.33.0
+	golang.org/x/net v0.35.0
+	golang.org/x/text v0.22.0
+	golang.org/x/time v0.9.0
 	gopkg.in/mail.v2 v2.3.1
 )
+
+require gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
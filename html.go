@@ -0,0 +1,252 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLToText returns a plain text representation of an HTML document that is
+// suitable as an alternative to an HTML message body. Scripts and styles are
+// removed, entities are decoded, list items are prefixed with markers and
+// indented by nesting level, table cells are separated by vertical bars,
+// and link targets are written in parentheses after link texts. The result
+// is meant to be readable, not to preserve all of the HTML formatting.
+func HTMLToText(s string) string {
+	z := html.NewTokenizer(strings.NewReader(s))
+	w := new(textWriter)
+
+	var (
+		skip  int // depth of elements with content that is not rendered
+		pre   int // depth of preformatted elements
+		lists []*list
+		cell  int // number of cells in the current table row
+		links []link
+	)
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return w.String()
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			w.text(string(z.Text()), pre > 0)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			selfClosing := tt == html.SelfClosingTagToken
+			switch t.DataAtom {
+			case atom.Script, atom.Style, atom.Head, atom.Noscript, atom.Template:
+				if !selfClosing {
+					skip++
+				}
+			case atom.Br:
+				w.newline(1)
+			case atom.Hr:
+				w.newline(2)
+				w.write("----------")
+				w.newline(2)
+			case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Blockquote, atom.Table:
+				w.newline(2)
+			case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Nav, atom.Main, atom.Aside, atom.Dl, atom.Dt, atom.Dd:
+				w.newline(1)
+			case atom.Pre:
+				w.newline(2)
+				if !selfClosing {
+					pre++
+				}
+			case atom.Ul, atom.Ol:
+				if len(lists) > 0 {
+					w.newline(1)
+				} else {
+					w.newline(2)
+				}
+				if !selfClosing {
+					lists = append(lists, &list{ordered: t.DataAtom == atom.Ol})
+				}
+			case atom.Li:
+				w.newline(1)
+				if len(lists) == 0 {
+					w.write("* ")
+					break
+				}
+				l := lists[len(lists)-1]
+				indent := strings.Repeat("  ", len(lists)-1)
+				if l.ordered {
+					l.count++
+					w.write(indent + strconv.Itoa(l.count) + ". ")
+				} else {
+					w.write(indent + "* ")
+				}
+			case atom.Tr:
+				w.newline(1)
+				cell = 0
+			case atom.Td, atom.Th:
+				if cell > 0 {
+					w.write(" | ")
+				}
+				cell++
+			case atom.A:
+				if !selfClosing {
+					links = append(links, link{href: attr(t, "href"), start: w.Len()})
+				}
+			case atom.Img:
+				if alt := attr(t, "alt"); alt != "" {
+					w.text(alt, false)
+				}
+			}
+		case html.EndTagToken:
+			t := z.Token()
+			switch t.DataAtom {
+			case atom.Script, atom.Style, atom.Head, atom.Noscript, atom.Template:
+				if skip > 0 {
+					skip--
+				}
+			case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Blockquote, atom.Table:
+				w.newline(2)
+			case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Nav, atom.Main, atom.Aside, atom.Dl, atom.Dt, atom.Dd, atom.Li, atom.Tr:
+				w.newline(1)
+			case atom.Pre:
+				if pre > 0 {
+					pre--
+				}
+				w.newline(2)
+			case atom.Ul, atom.Ol:
+				if len(lists) > 0 {
+					lists = lists[:len(lists)-1]
+				}
+				if len(lists) > 0 {
+					w.newline(1)
+				} else {
+					w.newline(2)
+				}
+			case atom.A:
+				if len(links) == 0 {
+					break
+				}
+				l := links[len(links)-1]
+				links = links[:len(links)-1]
+				if skip > 0 || !l.visible() {
+					break
+				}
+				text := strings.TrimSpace(w.b.String()[l.start:])
+				switch text {
+				case "":
+					w.text(l.href, false)
+				case l.href, strings.TrimPrefix(l.href, "mailto:"):
+				default:
+					w.text(" ("+l.href+")", false)
+				}
+			}
+		}
+	}
+}
+
+type list struct {
+	ordered bool
+	count   int
+}
+
+type link struct {
+	href  string
+	start int
+}
+
+func (l link) visible() bool {
+	return l.href != "" && !strings.HasPrefix(l.href, "#") && !strings.HasPrefix(strings.ToLower(l.href), "javascript:")
+}
+
+func attr(t html.Token, key string) string {
+	for _, a := range t.Attr {
+		if a.Key == key {
+			return strings.TrimSpace(a.Val)
+		}
+	}
+	return ""
+}
+
+// textWriter collapses whitespace of written text and keeps track of pending
+// line breaks, so that they are written only between text content.
+type textWriter struct {
+	b        strings.Builder
+	newlines int
+	space    bool
+}
+
+func (w *textWriter) text(s string, pre bool) {
+	if pre {
+		w.flush()
+		w.b.WriteString(s)
+		return
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		if s != "" {
+			w.space = true
+		}
+		return
+	}
+	if isSpace(s[0]) {
+		w.space = true
+	}
+	w.flush()
+	w.b.WriteString(strings.Join(fields, " "))
+	w.space = isSpace(s[len(s)-1])
+}
+
+func (w *textWriter) write(s string) {
+	w.space = false
+	w.flush()
+	w.b.WriteString(s)
+}
+
+func (w *textWriter) newline(n int) {
+	if n > w.newlines {
+		w.newlines = n
+	}
+	w.space = false
+}
+
+func (w *textWriter) flush() {
+	if w.b.Len() == 0 {
+		w.newlines = 0
+		w.space = false
+		return
+	}
+	if w.newlines > 0 {
+		w.b.WriteString(strings.Repeat("\n", w.newlines))
+		w.newlines = 0
+		w.space = false
+		return
+	}
+	if w.space {
+		if s := w.b.String(); !isSpace(s[len(s)-1]) {
+			w.b.WriteByte(' ')
+		}
+		w.space = false
+	}
+}
+
+func (w *textWriter) Len() int {
+	return w.b.Len()
+}
+
+func (w *textWriter) String() string {
+	lines := strings.Split(w.b.String(), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
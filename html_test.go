@@ -0,0 +1,69 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			name: "paragraphs",
+			html: `<html><head><title>Title</title><style>p { color: red; }</style></head>
+<body>
+	<h1>Hello,   Gopher!</h1>
+	<p>First&nbsp;line<br>second &amp; last line.</p>
+	<script>alert("hello");</script>
+	<p>Done.</p>
+</body></html>`,
+			want: "Hello, Gopher!\n\nFirst line\nsecond & last line.\n\nDone.",
+		},
+		{
+			name: "links",
+			html: `<p>Visit <a href="https://gopherpit.com">GopherPit</a>, write to <a href="mailto:support@gopherpit.com">support@gopherpit.com</a> or <a href="#top">go to top</a>. <a href="https://gopherpit.com/logo"><img src="logo.png"></a></p>`,
+			want: "Visit GopherPit (https://gopherpit.com), write to support@gopherpit.com or go to top. https://gopherpit.com/logo",
+		},
+		{
+			name: "nested list",
+			html: `<p>Steps:</p>
+<ol>
+	<li>Install
+		<ul>
+			<li>Download</li>
+			<li>Extract</li>
+		</ul>
+	</li>
+	<li>Run</li>
+</ol>
+<p>End</p>`,
+			want: "Steps:\n\n1. Install\n  * Download\n  * Extract\n2. Run\n\nEnd",
+		},
+		{
+			name: "table",
+			html: `<table>
+	<tr><th>Name</th><th>Quantity</th></tr>
+	<tr><td>Gopher</td><td>2</td></tr>
+	<tr><td><a href="https://gopherpit.com">Pit</a></td><td>1</td></tr>
+</table>`,
+			want: "Name | Quantity\nGopher | 2\nPit (https://gopherpit.com) | 1",
+		},
+		{
+			name: "preformatted",
+			html: "<p>Code:</p><pre>func main() {\n\tprintln(1)\n}</pre>",
+			want: "Code:\n\nfunc main() {\n\tprintln(1)\n}",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := HTMLToText(tc.html)
+			if got != tc.want {
+				t.Errorf("expected\n%q\ngot\n%q", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"net/mail"
+	"strings"
+	"sync"
+)
+
+var _ Sender = new(MemorySender)
+
+// MemorySender is a Sender that keeps all messages in memory instead of
+// sending them over the network. It is intended to be used in tests.
+type MemorySender struct {
+	// Addresses for Notify method.
+	NotifyAddresses []string
+	// From address for Notify method.
+	DefaultFrom string
+	// Subject prefix for Notify method. It is not space separated from subject value.
+	SubjectPrefix string
+
+	messages []MemoryMessage
+	mu       sync.Mutex
+}
+
+// MemoryMessage is a message recorded by MemorySender.
+type MemoryMessage struct {
+	From    string
+	To      []string
+	Subject string
+	Body    string
+	Headers map[string][]string
+}
+
+// SendEmail records an email message.
+func (s *MemorySender) SendEmail(from string, to []string, subject string, body string) error {
+	return s.SendEmailWithHeaders(from, to, subject, body, nil)
+}
+
+// SendEmailWithHeaders records an email message with additional headers.
+func (s *MemorySender) SendEmailWithHeaders(from string, to []string, subject string, body string, headers map[string][]string) error {
+	m := MemoryMessage{
+		From:    from,
+		To:      append([]string(nil), to...),
+		Subject: subject,
+		Body:    body,
+	}
+	if headers != nil {
+		m.Headers = make(map[string][]string, len(headers))
+		for k, v := range headers {
+			m.Headers[k] = append([]string(nil), v...)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, m)
+	return nil
+}
+
+// Notify records an email message to MemorySender.NotifyAddresses.
+func (s *MemorySender) Notify(subject, body string) error {
+	return s.NotifyWithHeaders(subject, body, nil)
+}
+
+// NotifyWithHeaders records an email message to MemorySender.NotifyAddresses
+// with additional headers.
+func (s *MemorySender) NotifyWithHeaders(subject, body string, headers map[string][]string) error {
+	if len(s.NotifyAddresses) == 0 {
+		return nil
+	}
+	return s.SendEmailWithHeaders(s.DefaultFrom, s.NotifyAddresses, s.SubjectPrefix+subject, body, headers)
+}
+
+// Messages returns all recorded messages in the order they were sent.
+func (s *MemorySender) Messages() []MemoryMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]MemoryMessage(nil), s.messages...)
+}
+
+// LastMessage returns the most recently recorded message or nil if no
+// messages are recorded.
+func (s *MemorySender) LastMessage() *MemoryMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) == 0 {
+		return nil
+	}
+	m := s.messages[len(s.messages)-1]
+	return &m
+}
+
+// MessagesTo returns all recorded messages that have the provided address
+// as one of the recipients. Only email addresses are compared, ignoring
+// display names.
+func (s *MemorySender) MessagesTo(addr string) []MemoryMessage {
+	addr = addressSpec(addr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var messages []MemoryMessage
+	for _, m := range s.messages {
+		for _, to := range m.To {
+			if strings.EqualFold(addressSpec(to), addr) {
+				messages = append(messages, m)
+				break
+			}
+		}
+	}
+	return messages
+}
+
+// Reset removes all recorded messages.
+func (s *MemorySender) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+}
+
+func addressSpec(addr string) string {
+	a, err := mail.ParseAddress(addr)
+	if err != nil {
+		return addr
+	}
+	return a.Address
+}
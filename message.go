@@ -0,0 +1,172 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"gopkg.in/mail.v2"
+)
+
+var (
+	// ErrNoRecipients is returned when a message has no To, Cc or Bcc
+	// addresses.
+	ErrNoRecipients = errors.New("email: no recipients")
+	// ErrNoBody is returned by Service.Send if the message has neither plain
+	// text nor HTML body.
+	ErrNoBody = errors.New("email: no body")
+)
+
+// Message is an email message that is sent with Service.Send.
+type Message struct {
+	// From address. Service.DefaultFrom is used if it is empty.
+	From string
+	// Envelope sender address, used in SMTP MAIL FROM command and for
+	// bounces, instead of the From address. It does not change the From
+	// header.
+	EnvelopeFrom string
+	// Recipient addresses.
+	To  []string
+	Cc  []string
+	Bcc []string
+	// Addresses for replies.
+	ReplyTo []string
+	Subject string
+	// Plain text body.
+	TextBody string
+	// HTML body. If TextBody is empty, the plain text part is generated from
+	// it with HTMLToText.
+	HTMLBody string
+	// Files attached to the message.
+	Attachments []Attachment
+	// Priority headers are set if it is not zero, overriding the ones in
+	// Headers.
+	Priority Priority
+	// List-Unsubscribe headers are set if it has URL or Mailto, overriding
+	// the ones in Headers.
+	ListUnsubscribe ListUnsubscribe
+	// Delivery status notifications that are requested if the SMTP server
+	// supports them.
+	DSN DSN
+	// Additional headers.
+	Headers map[string][]string
+}
+
+// Send sends the email message. If the message has both plain text and HTML
+// bodies, they are sent as multipart/alternative, and with attachments, as
+// multipart/mixed. The message is validated before the connection to the SMTP
+// server is established and ErrNoRecipients or ErrNoBody is returned if it
+// has no recipients or no body.
+func (s Service) Send(msg *Message) error {
+	if err := validateMessage(msg); err != nil {
+		return err
+	}
+	if !s.enabled() {
+		return s.disabledError()
+	}
+	m, body, err := s.buildMessage(msg)
+	if err != nil {
+		return err
+	}
+	return s.sendMessageFrom(context.Background(), m, msg.EnvelopeFrom, msg.DSN, m, body)
+}
+
+// Render returns the message as it would be sent by Send, without sending
+// it. The message is validated as with Send, and its serialized form as with
+// Service.VerifyMessages.
+func (s Service) Render(msg *Message) ([]byte, error) {
+	if err := validateMessage(msg); err != nil {
+		return nil, err
+	}
+	m, body, err := s.buildMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	from, _, err := s.envelope(m)
+	if err == nil && msg.EnvelopeFrom != "" {
+		from, err = s.envelopeAddress(msg.EnvelopeFrom)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !s.envelopeFromAllowed(from) {
+		return nil, fmt.Errorf("%w: %s", ErrEnvelopeFromNotAllowed, from)
+	}
+	var buf bytes.Buffer
+	if _, err := (foldedMessage{m}).WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	if err := verifyMessage(m, buf.Bytes(), body); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func validateMessage(msg *Message) error {
+	if len(msg.To) == 0 && len(msg.Cc) == 0 && len(msg.Bcc) == 0 {
+		return ErrNoRecipients
+	}
+	if msg.TextBody == "" && msg.HTMLBody == "" {
+		return ErrNoBody
+	}
+	return nil
+}
+
+// buildMessage returns the message with headers, body parts and attachments,
+// and its body as it is set in the message parts.
+func (s Service) buildMessage(msg *Message) (*mail.Message, messageBody, error) {
+
+	// Headers are copied as their values are encoded in place.
+	headers := make(map[string][]string, len(msg.Headers)+3)
+	for k, v := range msg.Headers {
+		headers[k] = append([]string(nil), v...)
+	}
+	for k, v := range msg.Priority.Headers() {
+		headers[k] = v
+	}
+	for k, v := range msg.ListUnsubscribe.Headers() {
+		headers[k] = v
+	}
+	for field, v := range map[string][]string{
+		"Cc":       msg.Cc,
+		"Bcc":      msg.Bcc,
+		"Reply-To": msg.ReplyTo,
+	} {
+		if len(v) > 0 {
+			headers[field] = append([]string(nil), v...)
+		}
+	}
+	from := msg.From
+	if from == "" {
+		from = s.DefaultFrom
+	}
+
+	m, err := s.newMessage(from, msg.To, msg.Subject, headers)
+	if err != nil {
+		return nil, messageBody{}, err
+	}
+	var body messageBody
+	switch {
+	case msg.HTMLBody == "":
+		body, err = s.setTextBody(m, msg.TextBody)
+	case msg.TextBody == "":
+		body, err = s.setAlternative(m, HTMLToText(msg.HTMLBody), msg.HTMLBody)
+	default:
+		body, err = s.setAlternative(m, msg.TextBody, msg.HTMLBody)
+	}
+	if err != nil {
+		return nil, messageBody{}, err
+	}
+	for _, a := range msg.Attachments {
+		if err := attach(m, a); err != nil {
+			return nil, messageBody{}, err
+		}
+	}
+	return m, body, nil
+}
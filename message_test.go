@@ -0,0 +1,256 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServiceSend(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost:    "localhost",
+		SMTPPort:    recorder.Port,
+		DefaultFrom: "noreply@gopherpit.com",
+	}
+
+	text := "Hello, gopher!\r\n"
+	html := "<p>Hello, <b>gopher</b>!</p>"
+	if err := service.Send(&Message{
+		To:       []string{"support@gopherpit.com"},
+		Cc:       []string{"sales@gopherpit.com"},
+		Bcc:      []string{"archive@gopherpit.com"},
+		ReplyTo:  []string{"help@gopherpit.com"},
+		Subject:  "test subject",
+		TextBody: text,
+		HTMLBody: html,
+		Attachments: []Attachment{
+			{Filename: "report.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4 report")},
+		},
+		Headers: map[string][]string{
+			"X-Campaign": {"42"},
+		},
+	}); err != nil {
+		t.Fatalf("send: %s", err)
+	}
+
+	var rcpts []string
+	for _, c := range recorder.Commands() {
+		switch {
+		case strings.HasPrefix(c, "MAIL "):
+			if c != "MAIL FROM:<noreply@gopherpit.com>" {
+				t.Errorf("unexpected envelope sender %q", c)
+			}
+		case strings.HasPrefix(c, "RCPT "):
+			rcpts = append(rcpts, c)
+		}
+	}
+	want := []string{
+		"RCPT TO:<support@gopherpit.com>",
+		"RCPT TO:<sales@gopherpit.com>",
+		"RCPT TO:<archive@gopherpit.com>",
+	}
+	if !reflect.DeepEqual(rcpts, want) {
+		t.Errorf("got recipients %q, expected %q", rcpts, want)
+	}
+
+	m := recorder.Message()
+	for field, want := range map[string]string{
+		"From":       "noreply@gopherpit.com",
+		"Cc":         "sales@gopherpit.com",
+		"Bcc":        "",
+		"Reply-To":   "help@gopherpit.com",
+		"X-Campaign": "42",
+	} {
+		if got := m.Header.Get(field); got != want {
+			t.Errorf("header %s: expected %q, got %q", field, want, got)
+		}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parse content type: %s", err)
+	}
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("expected multipart/mixed media type, got %s", mediaType)
+	}
+	r := multipart.NewReader(strings.NewReader(m.Body), params["boundary"])
+	p, err := r.NextRawPart()
+	if err != nil {
+		t.Fatalf("body part: %s", err)
+	}
+	body, err := ioutil.ReadAll(p)
+	if err != nil {
+		t.Fatalf("body part: read: %s", err)
+	}
+	checkAlternativeParts(t, &smtpMessage{
+		Header: map[string][]string{"Content-Type": {p.Header.Get("Content-Type")}},
+		Body:   string(body),
+	}, text, html)
+	p, err = r.NextRawPart()
+	if err != nil {
+		t.Fatalf("attachment: %s", err)
+	}
+	if got := p.Header.Get("Content-Type"); got != `application/pdf; name=report.pdf` {
+		t.Errorf("attachment: unexpected content type %q", got)
+	}
+}
+
+func TestServiceSendInvalid(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	for _, tc := range []struct {
+		name string
+		msg  *Message
+		want error
+	}{
+		{
+			name: "no recipients",
+			msg:  &Message{From: "gopher@gopherpit.com", Subject: "test", TextBody: "test body"},
+			want: ErrNoRecipients,
+		},
+		{
+			name: "no body",
+			msg:  &Message{From: "gopher@gopherpit.com", Bcc: []string{"support@gopherpit.com"}, Subject: "test"},
+			want: ErrNoBody,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := service.Send(tc.msg); err != tc.want {
+				t.Errorf("expected error %v, got %v", tc.want, err)
+			}
+		})
+	}
+	if commands := recorder.Commands(); len(commands) != 0 {
+		t.Errorf("expected no smtp commands, got %q", commands)
+	}
+}
+
+func TestServiceEnvelopeFrom(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		envelopeFrom string
+		send         func(s Service, envelopeFrom string) error
+	}{
+		{
+			name: "message",
+			send: func(s Service, envelopeFrom string) error {
+				return s.Send(&Message{
+					From:         "Gopher <gopher@gopherpit.com>",
+					EnvelopeFrom: envelopeFrom,
+					To:           []string{"support@gopherpit.com"},
+					Subject:      "test subject",
+					TextBody:     "test body",
+				})
+			},
+		},
+		{
+			name: "send email",
+			send: func(s Service, envelopeFrom string) error {
+				return s.SendEmailWithEnvelopeFrom(envelopeFrom, "Gopher <gopher@gopherpit.com>", []string{"support@gopherpit.com"}, "test subject", "test body")
+			},
+		},
+	} {
+		for envelopeFrom, want := range map[string]string{
+			"": "MAIL FROM:<gopher@gopherpit.com>",
+			"bounces+support=gopherpit.com@GopherPit.com": "MAIL FROM:<bounces+support=gopherpit.com@gopherpit.com>",
+		} {
+			t.Run(tc.name+" "+envelopeFrom, func(t *testing.T) {
+				recorder, err := newSMTPRecorder(t)
+				if err != nil {
+					t.Fatalf("smtp listen: %s", err)
+				}
+
+				service := Service{
+					SMTPHost: "localhost",
+					SMTPPort: recorder.Port,
+				}
+				if err := tc.send(service, envelopeFrom); err != nil {
+					t.Fatalf("send: %s", err)
+				}
+
+				var got string
+				for _, c := range recorder.Commands() {
+					if strings.HasPrefix(c, "MAIL ") {
+						got = c
+					}
+				}
+				if got != want {
+					t.Errorf("got %q, expected %q", got, want)
+				}
+				if from := recorder.Message().Header.Get("From"); from != "Gopher <gopher@gopherpit.com>" {
+					t.Errorf("unexpected From header %q", from)
+				}
+			})
+		}
+	}
+}
+
+func TestServiceRender(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	data, err := service.Render(&Message{
+		From:     "gopher@gopherpit.com",
+		To:       []string{"support@gopherpit.com"},
+		Bcc:      []string{"archive@gopherpit.com"},
+		Subject:  "test subject",
+		TextBody: "test body",
+		Priority: PriorityHigh,
+	})
+	if err != nil {
+		t.Fatalf("render: %s", err)
+	}
+
+	m := parseSMTPMessage(t, data)
+	if m.Subject != "test subject" || m.Body != "test body" {
+		t.Errorf("got message %+v", m)
+	}
+	if got := m.Header.Get("Importance"); got != "high" {
+		t.Errorf("got Importance header %q, expected %q", got, "high")
+	}
+	if got := m.Header.Get("Bcc"); got != "" {
+		t.Errorf("unexpected Bcc header %q", got)
+	}
+
+	service.AllowedEnvelopeFrom = []string{"noreply@gopherpit.com"}
+	if _, err := service.Render(&Message{
+		From:     "gopher@gopherpit.com",
+		To:       []string{"support@gopherpit.com"},
+		Subject:  "test subject",
+		TextBody: "test body",
+	}); !errors.Is(err, ErrEnvelopeFromNotAllowed) {
+		t.Errorf("expected error %v, got %v", ErrEnvelopeFromNotAllowed, err)
+	}
+	if commands := recorder.Commands(); len(commands) != 0 {
+		t.Errorf("expected no smtp commands, got %q", commands)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"errors"
+	"time"
+)
+
+// Metrics receives measurements of messages sent by Service, so that they can
+// be exposed with a metrics library, for example as Prometheus counters and
+// histograms. Labels are the same for every call with the same metric name.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Inc increments the counter with the name and labels by the value.
+	Inc(name string, value float64, labels map[string]string)
+	// Observe adds the value to the distribution with the name and labels.
+	Observe(name string, value float64, labels map[string]string)
+}
+
+// Names of metrics that Service reports to Metrics.
+const (
+	// MetricSent counts successfully sent messages.
+	MetricSent = "email_sent_total"
+	// MetricSentBytes counts bytes of successfully sent messages.
+	MetricSentBytes = "email_sent_bytes_total"
+	// MetricFailed counts messages that failed to be sent, with label
+	// "stage" set to the SendError stage, or to an empty string if the
+	// stage is not known.
+	MetricFailed = "email_failed_total"
+	// MetricRetried counts retried send attempts.
+	MetricRetried = "email_retried_total"
+	// MetricSendDuration observes durations in seconds of both successful
+	// and failed sends, including retries.
+	MetricSendDuration = "email_send_duration_seconds"
+)
+
+// recordMetrics reports the result of sending a single message to metrics.
+func recordMetrics(m Metrics, bytes int64, latency time.Duration, err error) {
+	m.Observe(MetricSendDuration, latency.Seconds(), nil)
+	if err != nil {
+		var stage Stage
+		var e *SendError
+		if errors.As(err, &e) {
+			stage = e.Stage
+		}
+		m.Inc(MetricFailed, 1, map[string]string{"stage": string(stage)})
+		return
+	}
+	m.Inc(MetricSent, 1, nil)
+	m.Inc(MetricSentBytes, float64(bytes), nil)
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServiceMetrics(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	metrics := new(testMetrics)
+	service := Service{
+		SMTPHost:      "localhost",
+		SMTPPort:      recorder.Port,
+		Metrics:       metrics,
+		RetryAttempts: 1,
+		RetryBackoff:  time.Millisecond,
+	}
+
+	if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+	n := len(recorder.Message().Data)
+
+	recorder.SetReply("RCPT", "451 4.3.0 Try again later")
+	if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	want := []string{
+		"inc email_failed_total map[stage:rcpt]",
+		"inc email_retried_total map[]",
+		"inc email_sent_bytes_total map[]",
+		"inc email_sent_total map[]",
+		"observe email_send_duration_seconds map[]",
+		"observe email_send_duration_seconds map[]",
+	}
+	if got := metrics.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got calls %q, expected %q", got, want)
+	}
+	// Recorded data has line endings normalized to CRLF, so it may be
+	// larger than the message.
+	if got := metrics.values[MetricSentBytes]; got <= 0 || got > float64(n) {
+		t.Errorf("got %v sent bytes, expected at most %v", got, n)
+	}
+}
+
+// testMetrics records calls to Metrics methods.
+type testMetrics struct {
+	calls  []string
+	values map[string]float64
+	mu     sync.Mutex
+}
+
+func (m *testMetrics) Inc(name string, value float64, labels map[string]string) {
+	m.record("inc", name, value, labels)
+}
+
+func (m *testMetrics) Observe(name string, value float64, labels map[string]string) {
+	m.record("observe", name, value, labels)
+}
+
+func (m *testMetrics) record(method, name string, value float64, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Maps are printed with sorted keys.
+	m.calls = append(m.calls, fmt.Sprint(method, " ", name, " ", labels))
+	if m.values == nil {
+		m.values = make(map[string]float64)
+	}
+	m.values[name] += value
+}
+
+// Calls returns recorded calls in sorted order.
+func (m *testMetrics) Calls() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	calls := append([]string(nil), m.calls...)
+	sort.Strings(calls)
+	return calls
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Middleware wraps a Sender to add functionality around sending, such as
+// logging, rate limiting or retrying. Middlewares provided by this package
+// are Retry, RateLimit, Logging and CircuitBreaker.
+type Middleware func(Sender) Sender
+
+// Chain returns a Sender that sends messages through base wrapped with all
+// provided middlewares. The first middleware is the outermost one and it is
+// the first one to handle every call.
+func Chain(base Sender, mw ...Middleware) Sender {
+	for i := len(mw) - 1; i >= 0; i-- {
+		base = mw[i](base)
+	}
+	return base
+}
+
+// ErrCircuitOpen is returned by a Sender wrapped with CircuitBreaker when
+// messages are not sent because of previous failures.
+var ErrCircuitOpen = errors.New("email: circuit open")
+
+// Retry returns a Middleware that calls the wrapped Sender again, at most
+// attempts times, when it returns a temporary error, as reported by
+// SendError.IsTemporary. The duration to wait before the first retry is
+// backoff, and it is doubled and randomly reduced for following retries, as
+// with Service.RetryBackoff. Waiting stops and the context error is returned
+// when ctx is done, for example on shutdown.
+//
+// If the wrapped Sender is a Service with RetryAttempts, every call already
+// retries delivery, so the number of attempts is multiplied. Only one of them
+// should be used.
+func Retry(ctx context.Context, attempts int, backoff time.Duration) Middleware {
+	return func(next Sender) Sender {
+		return middlewareSender{next: next, call: func(_ string, send func() error) error {
+			for attempt := 0; ; attempt++ {
+				err := send()
+				if err == nil || attempt >= attempts || !isTemporary(err) {
+					return err
+				}
+				if err := sleep(ctx, backoffDelay(backoff, attempt)); err != nil {
+					return err
+				}
+			}
+		}}
+	}
+}
+
+// RateLimit returns a Middleware that waits for the limiter before every
+// call to the wrapped Sender. The same limiter can be used for more
+// Senders. Waiting stops and an error is returned when ctx is done, for
+// example on shutdown.
+//
+// Service.RateLimiter waits before every delivery attempt, including
+// retries, while this limiter waits once for every call. Setting the same
+// limiter to both takes two tokens for every message.
+func RateLimit(ctx context.Context, limiter *rate.Limiter) Middleware {
+	return func(next Sender) Sender {
+		return middlewareSender{next: next, call: func(_ string, send func() error) error {
+			if err := limiter.Wait(ctx); err != nil {
+				return err
+			}
+			return send()
+		}}
+	}
+}
+
+// Logging returns a Middleware that logs every call to the wrapped Sender
+// with the name of the method, its duration and the error, if any. The
+// logf function can be log.Printf, for example.
+func Logging(logf func(format string, args ...interface{})) Middleware {
+	return func(next Sender) Sender {
+		return middlewareSender{next: next, call: func(method string, send func() error) error {
+			start := time.Now()
+			err := send()
+			if err != nil {
+				logf("email: %s failed after %s: %v", method, time.Since(start), err)
+			} else {
+				logf("email: %s done in %s", method, time.Since(start))
+			}
+			return err
+		}}
+	}
+}
+
+// CircuitBreaker returns a Middleware that stops calling the wrapped Sender
+// after threshold consecutive failures to deliver messages, which are
+// errors of type SendError, and returns ErrCircuitOpen instead. After the
+// cooldown, one message is sent to check whether delivery works again, and
+// the circuit is closed if it succeeds.
+func CircuitBreaker(threshold int, cooldown time.Duration) Middleware {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return func(next Sender) Sender {
+		b := &circuitBreaker{threshold: threshold, cooldown: cooldown}
+		return middlewareSender{next: next, call: b.call}
+	}
+}
+
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	failures  int
+	openUntil time.Time
+	mu        sync.Mutex
+}
+
+func (b *circuitBreaker) call(_ string, send func() error) error {
+	b.mu.Lock()
+	if b.failures >= b.threshold {
+		if time.Now().Before(b.openUntil) {
+			b.mu.Unlock()
+			return ErrCircuitOpen
+		}
+		// Only one message is sent until the cooldown elapses again.
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+	b.mu.Unlock()
+
+	err := send()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var e *SendError
+	switch {
+	case err == nil:
+		b.failures = 0
+	case errors.As(err, &e):
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openUntil = time.Now().Add(b.cooldown)
+		}
+	}
+	return err
+}
+
+// middlewareSender is a Sender that calls every method of the next Sender
+// with the call function.
+type middlewareSender struct {
+	next Sender
+	call func(method string, send func() error) error
+}
+
+func (s middlewareSender) SendEmail(from string, to []string, subject string, body string) error {
+	return s.call("SendEmail", func() error {
+		return s.next.SendEmail(from, to, subject, body)
+	})
+}
+
+func (s middlewareSender) SendEmailWithHeaders(from string, to []string, subject string, body string, headers map[string][]string) error {
+	return s.call("SendEmailWithHeaders", func() error {
+		return s.next.SendEmailWithHeaders(from, to, subject, body, headers)
+	})
+}
+
+func (s middlewareSender) Notify(subject, body string) error {
+	return s.call("Notify", func() error {
+		return s.next.Notify(subject, body)
+	})
+}
+
+func (s middlewareSender) NotifyWithHeaders(subject, body string, headers map[string][]string) error {
+	return s.call("NotifyWithHeaders", func() error {
+		return s.next.NotifyWithHeaders(subject, body, headers)
+	})
+}
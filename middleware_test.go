@@ -0,0 +1,260 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type callRecorder struct {
+	calls []string
+}
+
+func (r *callRecorder) middleware(name string) Middleware {
+	return func(next Sender) Sender {
+		return &recordingSender{Sender: next, name: name, recorder: r}
+	}
+}
+
+type recordingSender struct {
+	Sender
+	name     string
+	recorder *callRecorder
+}
+
+func (s *recordingSender) SendEmail(from string, to []string, subject string, body string) error {
+	s.recorder.calls = append(s.recorder.calls, s.name)
+	return s.Sender.SendEmail(from, to, subject, body)
+}
+
+func TestChain(t *testing.T) {
+	base := new(MemorySender)
+	r := new(callRecorder)
+
+	sender := Chain(base, r.middleware("first"), r.middleware("second"))
+
+	if err := sender.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	if want := []string{"first", "second"}; !reflect.DeepEqual(r.calls, want) {
+		t.Errorf("expected calls %q, got %q", want, r.calls)
+	}
+	if got := len(base.Messages()); got != 1 {
+		t.Errorf("expected 1 message, got %v", got)
+	}
+}
+
+func TestChainError(t *testing.T) {
+	errBlocked := errors.New("blocked")
+	block := func(next Sender) Sender {
+		return &blockingSender{Sender: next, err: errBlocked}
+	}
+	base := new(MemorySender)
+	r := new(callRecorder)
+
+	sender := Chain(base, r.middleware("first"), block, r.middleware("last"))
+
+	if err := sender.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != errBlocked {
+		t.Fatalf("expected error %v, got %v", errBlocked, err)
+	}
+
+	if want := []string{"first"}; !reflect.DeepEqual(r.calls, want) {
+		t.Errorf("expected calls %q, got %q", want, r.calls)
+	}
+	if got := len(base.Messages()); got != 0 {
+		t.Errorf("expected no messages, got %v", got)
+	}
+}
+
+type blockingSender struct {
+	Sender
+	err error
+}
+
+func (s *blockingSender) SendEmail(string, []string, string, string) error {
+	return s.err
+}
+
+func TestChainNoMiddleware(t *testing.T) {
+	base := new(MemorySender)
+	if sender := Chain(base); sender != Sender(base) {
+		t.Errorf("expected base sender, got %v", sender)
+	}
+}
+
+// failingSender returns the errors in order for every call, and nil when
+// there are no more errors.
+type failingSender struct {
+	MemorySender
+	errs  []error
+	calls int
+}
+
+func (s *failingSender) SendEmail(from string, to []string, subject string, body string) error {
+	s.calls++
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return err
+	}
+	return s.MemorySender.SendEmail(from, to, subject, body)
+}
+
+var (
+	errTemporary = &SendError{Stage: StageData, Code: 451, Err: &SMTPError{Command: "DATA", Code: 451, Message: "Try again later"}}
+	errPermanent = &SendError{Stage: StageRcpt, Code: 550, Err: &SMTPError{Command: "RCPT", Code: 550, Message: "User unknown"}}
+)
+
+func TestRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		attempts  int
+		errs      []error
+		wantErr   error
+		wantCalls int
+	}{
+		{
+			name:      "success after retries",
+			attempts:  2,
+			errs:      []error{errTemporary, errTemporary},
+			wantCalls: 3,
+		},
+		{
+			name:      "attempts exceeded",
+			attempts:  1,
+			errs:      []error{errTemporary, errTemporary},
+			wantErr:   errTemporary,
+			wantCalls: 2,
+		},
+		{
+			name:      "permanent error",
+			attempts:  2,
+			errs:      []error{errPermanent},
+			wantErr:   errPermanent,
+			wantCalls: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			base := &failingSender{errs: tc.errs}
+			sender := Chain(base, Retry(context.Background(), tc.attempts, 0))
+
+			if err := sender.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != tc.wantErr {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if base.calls != tc.wantCalls {
+				t.Errorf("expected %v calls, got %v", tc.wantCalls, base.calls)
+			}
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	base := &failingSender{errs: []error{errTemporary}}
+	sender := Chain(base, Retry(ctx, 1, time.Hour))
+
+	if err := sender.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != context.Canceled {
+		t.Fatalf("expected error %v, got %v", context.Canceled, err)
+	}
+	if base.calls != 1 {
+		t.Errorf("expected 1 call, got %v", base.calls)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	base := new(MemorySender)
+
+	sender := Chain(base, RateLimit(context.Background(), rate.NewLimiter(rate.Inf, 1)))
+	if err := sender.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	// Limiter with zero burst does not allow any events.
+	sender = Chain(base, RateLimit(context.Background(), rate.NewLimiter(1, 0)))
+	if err := sender.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err == nil {
+		t.Fatal("expected error")
+	}
+	// Waiting for the limiter stops when the context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sender = Chain(base, RateLimit(ctx, rate.NewLimiter(rate.Every(time.Hour), 1)))
+	if err := sender.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err == nil {
+		t.Fatal("expected error")
+	}
+	if got := len(base.Messages()); got != 1 {
+		t.Errorf("expected 1 message, got %v", got)
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var lines []string
+	logf := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	base := &failingSender{errs: []error{errPermanent}}
+	base.NotifyAddresses = []string{"support@gopherpit.com"}
+	sender := Chain(base, Logging(logf))
+
+	if err := sender.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != errPermanent {
+		t.Fatalf("expected error %v, got %v", errPermanent, err)
+	}
+	if err := sender.Notify("test subject", "test body"); err != nil {
+		t.Fatalf("notify: %s", err)
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %q", lines)
+	}
+	if want := "email: SendEmail failed after "; !strings.HasPrefix(lines[0], want) || !strings.HasSuffix(lines[0], errPermanent.Error()) {
+		t.Errorf("unexpected log line %q", lines[0])
+	}
+	if want := "email: Notify done in "; !strings.HasPrefix(lines[1], want) {
+		t.Errorf("unexpected log line %q", lines[1])
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	errInvalid := errors.New("invalid message")
+	base := &failingSender{errs: []error{errInvalid, errTemporary, errTemporary, errTemporary, errTemporary}}
+	cooldown := 50 * time.Millisecond
+	// Retries are counted as a single failure of the circuit breaker.
+	sender := Chain(base, CircuitBreaker(2, cooldown), Retry(context.Background(), 1, 0))
+
+	send := func() error {
+		return sender.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+	}
+
+	for i, want := range []error{errInvalid, errTemporary, errTemporary, ErrCircuitOpen} {
+		if err := send(); err != want {
+			t.Fatalf("send %v: expected error %v, got %v", i, want, err)
+		}
+	}
+	if base.calls != 5 {
+		t.Errorf("expected 5 calls, got %v", base.calls)
+	}
+
+	time.Sleep(cooldown)
+	if err := send(); err != nil {
+		t.Fatalf("send after cooldown: %s", err)
+	}
+	if err := send(); err != nil {
+		t.Fatalf("send after closing: %s", err)
+	}
+	if got := len(base.Messages()); got != 2 {
+		t.Errorf("expected 2 messages, got %v", got)
+	}
+}
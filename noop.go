@@ -0,0 +1,62 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"errors"
+	"strconv"
+)
+
+// NoOpReason describes why a message was not sent.
+type NoOpReason int
+
+// Reasons for not sending a message.
+const (
+	// NoRecipients is the reason when there are no recipients, including
+	// Notify methods when Service.NotifyAddresses is empty.
+	NoRecipients NoOpReason = iota + 1
+	// Disabled is the reason when Service.Enabled returned false.
+	Disabled
+	// OutsideWindow is the reason when the current time is outside of
+	// Service.SendWindow.
+	OutsideWindow
+)
+
+func (r NoOpReason) String() string {
+	switch r {
+	case NoRecipients:
+		return "no recipients"
+	case Disabled:
+		return "disabled"
+	case OutsideWindow:
+		return "outside window"
+	}
+	return "no-op reason(" + strconv.Itoa(int(r)) + ")"
+}
+
+// NoOpReasonOf returns the reason why a message was not sent if err is
+// returned by a send method for a message that was intentionally not sent,
+// and false otherwise. Notify methods when Service.NotifyAddresses is empty,
+// and send methods when sending is disabled and Service.DisabledNoOp is set,
+// return nil error, and those no-ops are reported only to Service.AfterNoOp.
+func NoOpReasonOf(err error) (NoOpReason, bool) {
+	switch {
+	case errors.Is(err, ErrNoRecipients):
+		return NoRecipients, true
+	case errors.Is(err, ErrSendingDisabled):
+		return Disabled, true
+	case errors.Is(err, ErrOutsideSendWindow):
+		return OutsideWindow, true
+	}
+	return 0, false
+}
+
+// noOp calls Service.AfterNoOp if it is set.
+func (s Service) noOp(reason NoOpReason) {
+	if s.AfterNoOp != nil {
+		s.AfterNoOp(reason)
+	}
+}
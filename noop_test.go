@@ -0,0 +1,129 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServiceAfterNoOp(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		service Service
+		send    func(s Service) error
+		wantErr error
+		want    NoOpReason
+	}{
+		{
+			name: "sent",
+			send: func(s Service) error {
+				return s.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+			},
+		},
+		{
+			name: "no notify addresses",
+			send: func(s Service) error {
+				return s.Notify("test subject", "test body")
+			},
+			want: NoRecipients,
+		},
+		{
+			name: "no recipients",
+			send: func(s Service) error {
+				return s.SendEmail("gopher@gopherpit.com", nil, "test subject", "test body")
+			},
+			wantErr: ErrNoRecipients,
+			want:    NoRecipients,
+		},
+		{
+			name: "raw no recipients",
+			send: func(s Service) error {
+				return s.SendRaw("gopher@gopherpit.com", nil, []byte("Subject: test subject\r\n\r\ntest body\r\n"))
+			},
+			wantErr: ErrNoRecipients,
+			want:    NoRecipients,
+		},
+		{
+			name: "disabled",
+			service: Service{
+				Enabled: func() bool { return false },
+			},
+			send: func(s Service) error {
+				return s.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+			},
+			wantErr: ErrSendingDisabled,
+			want:    Disabled,
+		},
+		{
+			name: "disabled no-op",
+			service: Service{
+				Enabled:      func() bool { return false },
+				DisabledNoOp: true,
+			},
+			send: func(s Service) error {
+				return s.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+			},
+			want: Disabled,
+		},
+		{
+			name: "outside window",
+			service: Service{
+				SendWindow: &SendWindow{Start: 8, End: 20},
+				Now: func() time.Time {
+					return time.Date(2016, 10, 16, 23, 0, 0, 0, time.UTC)
+				},
+			},
+			send: func(s Service) error {
+				return s.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+			},
+			wantErr: ErrOutsideSendWindow,
+			want:    OutsideWindow,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder.SetMessage(nil)
+
+			var got []NoOpReason
+			service := tc.service
+			service.SMTPHost = "localhost"
+			service.SMTPPort = recorder.Port
+			service.AfterNoOp = func(reason NoOpReason) {
+				got = append(got, reason)
+			}
+
+			err := tc.send(service)
+			if err != tc.wantErr {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if reason, ok := NoOpReasonOf(err); tc.wantErr != nil && (!ok || reason != tc.want) {
+				t.Errorf("expected no-op reason of error %q, got %q", tc.want, reason)
+			} else if tc.wantErr == nil && ok {
+				t.Errorf("expected no no-op reason of error, got %q", reason)
+			}
+			if tc.want == 0 {
+				if len(got) != 0 {
+					t.Errorf("expected no no-op, got %v", got)
+				}
+				if recorder.Message() == nil {
+					t.Error("message not recorded")
+				}
+				return
+			}
+			if len(got) != 1 || got[0] != tc.want {
+				t.Errorf("expected no-op %q, got %v", tc.want, got)
+			}
+			if recorder.Message() != nil {
+				t.Errorf("expected no message, but message %#v has been recorded", recorder.Message())
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+var (
+	// ErrOCSPStapleMissing is returned when Service.SMTPRequireOCSPStaple is
+	// set and the SMTP server does not staple an OCSP response.
+	ErrOCSPStapleMissing = errors.New("email: ocsp staple missing")
+	// ErrCertificateRevoked is returned when the stapled OCSP response reports
+	// that the SMTP server certificate is revoked.
+	ErrCertificateRevoked = errors.New("email: certificate revoked")
+	// ErrOCSPStatusUnknown is returned when the stapled OCSP response does not
+	// confirm that the SMTP server certificate is valid.
+	ErrOCSPStatusUnknown = errors.New("email: ocsp status unknown")
+)
+
+// verifyOCSPStaple is used as tls.Config.VerifyConnection function to require
+// a valid stapled OCSP response that reports the server certificate as good.
+func verifyOCSPStaple(cs tls.ConnectionState) error {
+	if len(cs.OCSPResponse) == 0 {
+		return ErrOCSPStapleMissing
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("email: no peer certificates")
+	}
+
+	var issuer *x509.Certificate
+	if len(cs.VerifiedChains) > 0 && len(cs.VerifiedChains[0]) > 1 {
+		issuer = cs.VerifiedChains[0][1]
+	} else if len(cs.PeerCertificates) > 1 {
+		issuer = cs.PeerCertificates[1]
+	}
+	if issuer == nil {
+		return errors.New("email: ocsp: issuer certificate not found")
+	}
+
+	r, err := ocsp.ParseResponseForCert(cs.OCSPResponse, cs.PeerCertificates[0], issuer)
+	if err != nil {
+		return fmt.Errorf("email: ocsp: %w", err)
+	}
+	if !r.NextUpdate.IsZero() && time.Now().After(r.NextUpdate) {
+		return errors.New("email: ocsp: stale response")
+	}
+	switch r.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return ErrCertificateRevoked
+	default:
+		return ErrOCSPStatusUnknown
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestServiceRequireOCSPStaple(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		require bool
+		status  int // -1 for no staple
+		wantErr error
+	}{
+		{
+			name:    "good",
+			require: true,
+			status:  ocsp.Good,
+		},
+		{
+			name:    "revoked",
+			require: true,
+			status:  ocsp.Revoked,
+			wantErr: ErrCertificateRevoked,
+		},
+		{
+			name:    "unknown",
+			require: true,
+			status:  ocsp.Unknown,
+			wantErr: ErrOCSPStatusUnknown,
+		},
+		{
+			name:    "missing",
+			require: true,
+			status:  -1,
+			wantErr: ErrOCSPStapleMissing,
+		},
+		{
+			name:   "not required",
+			status: -1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder, err := newSMTPRecorder(t)
+			if err != nil {
+				t.Fatalf("smtp listen: %s", err)
+			}
+			recorder.SetTLSConfig(&tls.Config{
+				Certificates: []tls.Certificate{newTestCertificate(t, tc.status)},
+			})
+
+			service := Service{
+				SMTPHost:              "localhost",
+				SMTPPort:              recorder.Port,
+				SMTPSkipVerify:        true,
+				SMTPRequireOCSPStaple: tc.require,
+			}
+
+			err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+			if tc.wantErr == nil {
+				if err != nil {
+					t.Fatalf("send email: %s", err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestServiceRequireOCSPStapleNoStartTLS(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost:              "localhost",
+		SMTPPort:              recorder.Port,
+		SMTPRequireOCSPStaple: true,
+	}
+
+	if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err == nil {
+		t.Fatal("expected error without STARTTLS")
+	}
+	if recorder.Message() != nil {
+		t.Errorf("expected no message, but message %#v has been recorded", recorder.Message())
+	}
+}
+
+// newTestCertificate returns a certificate for localhost signed by a newly
+// created certificate authority with a stapled OCSP response with the provided
+// status. If status is negative, the response is not stapled.
+func newTestCertificate(t *testing.T, status int) tls.Certificate {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := tls.Certificate{
+		Certificate: [][]byte{der, caDER},
+		PrivateKey:  key,
+	}
+	if status < 0 {
+		return cert
+	}
+
+	r := ocsp.Response{
+		Status:       status,
+		SerialNumber: template.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   time.Now().Add(time.Hour),
+	}
+	if status == ocsp.Revoked {
+		r.RevokedAt = time.Now().Add(-time.Minute)
+		r.RevocationReason = ocsp.KeyCompromise
+	}
+	cert.OCSPStaple, err = ocsp.CreateResponse(ca, ca, r, crypto.Signer(caKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned when a message is sent with a closed Pool.
+var ErrPoolClosed = errors.New("email: pool closed")
+
+// Pool sends email messages over a limited number of SMTP connections that
+// are reused between messages. It is safe for concurrent use. A Pool of size
+// 1 keeps a single connection open, for example for frequent Notify calls.
+type Pool struct {
+	service Service
+	// Slots limit the number of open connections.
+	slots chan struct{}
+	idle  chan *smtpClient
+
+	mu     sync.Mutex
+	closed bool
+}
+
+var _ Sender = (*Pool)(nil)
+
+// NewPool returns a new Pool that sends messages with the service
+// configuration over at most size connections at the same time. Connections
+// are not used if the service has SendmailPath or Transport set.
+func NewPool(service Service, size int) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	p := &Pool{
+		slots: make(chan struct{}, size),
+		idle:  make(chan *smtpClient, size),
+	}
+	service.transport = p.send
+	p.service = service
+	return p
+}
+
+// SendEmail sends an email message.
+func (p *Pool) SendEmail(from string, to []string, subject string, body string) error {
+	return p.service.SendEmail(from, to, subject, body)
+}
+
+// SendEmailWithHeaders sends an email message with additional headers.
+func (p *Pool) SendEmailWithHeaders(from string, to []string, subject string, body string, headers map[string][]string) error {
+	return p.service.SendEmailWithHeaders(from, to, subject, body, headers)
+}
+
+// Notify sends an email message to Service.NotifyAddresses.
+func (p *Pool) Notify(subject, body string) error {
+	return p.service.Notify(subject, body)
+}
+
+// NotifyWithHeaders sends an email message to Service.NotifyAddresses with
+// additional headers.
+func (p *Pool) NotifyWithHeaders(subject, body string, headers map[string][]string) error {
+	return p.service.NotifyWithHeaders(subject, body, headers)
+}
+
+// Close terminates all idle connections with QUIT command. Connections that
+// are in use are terminated when their messages are sent.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	var err error
+	for {
+		select {
+		case c := <-p.idle:
+			if e := c.quit(); e != nil && err == nil {
+				err = e
+			}
+		default:
+			return err
+		}
+	}
+}
+
+// send delivers the message content over an idle connection, or over a new
+// one if there are no idle connections. The connection is closed, and not
+// reused, if the context is canceled.
+func (p *Pool) send(ctx context.Context, from string, to []string, content io.WriterTo, opts sendOptions) (int64, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	c, err := p.get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		c.close()
+	})
+	n, err := c.sendMail(from, to, content, opts)
+	if !stop() {
+		if err != nil {
+			err = ctx.Err()
+		}
+		return n, err
+	}
+	var e *SMTPError
+	if err != nil && !errors.As(err, &e) {
+		// The connection is not usable after a network error.
+		c.close()
+		return n, err
+	}
+	p.put(c)
+	return n, err
+}
+
+// get returns an idle connection which is reset and verified to be alive, or
+// a new connection. Connections that are idle for longer than
+// Service.SMTPIdleTimeout are terminated.
+func (p *Pool) get(ctx context.Context) (*smtpClient, error) {
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		return nil, ErrPoolClosed
+	}
+	for {
+		select {
+		case c := <-p.idle:
+			if err := c.conn.SetDeadline(time.Now().Add(durationOr(p.service.SendTimeout, sendTimeout))); err == nil {
+				if d := p.service.SMTPIdleTimeout; d > 0 && p.service.now().Sub(c.idleSince) > d {
+					_ = c.quit()
+					continue
+				}
+				// RSET discards any state from the previous transaction and
+				// detects connections closed by the server.
+				if err := c.reset(); err == nil {
+					return c, nil
+				}
+			}
+			c.close()
+		default:
+			return p.service.dial(ctx)
+		}
+	}
+}
+
+// put returns the connection to idle connections, or terminates it if the
+// pool is closed.
+func (p *Pool) put(c *smtpClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		_ = c.quit()
+		return
+	}
+	c.idleSince = p.service.now()
+	select {
+	case p.idle <- c:
+	default:
+		_ = c.quit()
+	}
+}
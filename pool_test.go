@@ -0,0 +1,297 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func countCommands(commands []string, verb string) (n int) {
+	for _, c := range commands {
+		if strings.HasPrefix(c, verb) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPool(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	pool := NewPool(Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}, 1)
+
+	for i := 0; i < 3; i++ {
+		if err := pool.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+			t.Fatalf("send email %v: %s", i, err)
+		}
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	commands := recorder.Commands()
+	for verb, want := range map[string]int{
+		"EHLO": 1,
+		"RSET": 2,
+		"DATA": 3,
+		"QUIT": 1,
+	} {
+		if got := countCommands(commands, verb); got != want {
+			t.Errorf("expected %v %s commands, got %v", want, verb, got)
+		}
+	}
+
+	err = pool.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+	if !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("expected error %v, got %v", ErrPoolClosed, err)
+	}
+}
+
+func TestPoolReconnect(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	pool := NewPool(Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}, 1)
+	defer pool.Close()
+
+	if err := pool.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	// Break the idle connection.
+	c := <-pool.idle
+	c.conn.Close()
+	pool.idle <- c
+
+	if err := pool.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+		t.Fatalf("send email after connection failure: %s", err)
+	}
+
+	commands := recorder.Commands()
+	if got := countCommands(commands, "EHLO"); got != 2 {
+		t.Errorf("expected 2 EHLO commands, got %v", got)
+	}
+	if got := countCommands(commands, "DATA"); got != 2 {
+		t.Errorf("expected 2 DATA commands, got %v", got)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	now := time.Now()
+	pool := NewPool(Service{
+		SMTPHost:        "localhost",
+		SMTPPort:        recorder.Port,
+		SMTPIdleTimeout: time.Minute,
+		NotifyAddresses: []string{"operations@gopherpit.com"},
+		DefaultFrom:     "noreply@gopherpit.com",
+		Now: func() time.Time {
+			return now
+		},
+	}, 1)
+	defer pool.Close()
+
+	for _, idle := range []time.Duration{0, 30 * time.Second, 2 * time.Minute} {
+		now = now.Add(idle)
+		if err := pool.Notify("test subject", "test body"); err != nil {
+			t.Fatalf("notify after %v: %s", idle, err)
+		}
+	}
+
+	commands := recorder.Commands()
+	for verb, want := range map[string]int{
+		"EHLO": 2,
+		"RSET": 1,
+		"DATA": 3,
+		"QUIT": 1,
+	} {
+		if got := countCommands(commands, verb); got != want {
+			t.Errorf("expected %v %s commands, got %v", want, verb, got)
+		}
+	}
+}
+
+func TestPoolSMTPError(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	pool := NewPool(Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}, 1)
+	defer pool.Close()
+
+	recorder.SetReply("RCPT", "550 5.1.1 Unknown user")
+	var e *SMTPError
+	if err := pool.SendEmail("gopher@gopherpit.com", []string{"unknown@gopherpit.com"}, "test subject", "test body"); !errors.As(err, &e) {
+		t.Fatalf("expected smtp error, got %v", err)
+	}
+	recorder.SetReply("RCPT", "")
+	if err := pool.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	if got := countCommands(recorder.Commands(), "EHLO"); got != 1 {
+		t.Errorf("expected connection to be reused after smtp error, got %v EHLO commands", got)
+	}
+}
+
+func TestPoolCanceled(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+
+	// The server does not reply to MAIL command, and reports when the
+	// connection is closed by the client.
+	closed := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		defer close(closed)
+		r := bufio.NewReader(conn)
+		_, _ = conn.Write([]byte("220 localhost ESMTP\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "EHLO") {
+				_, _ = conn.Write([]byte("250 localhost\r\n"))
+			}
+		}
+	}()
+
+	pool := NewPool(Service{
+		SMTPHost:    "localhost",
+		SMTPPort:    l.Addr().(*net.TCPAddr).Port,
+		SendTimeout: 10 * time.Second,
+	}, 1)
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	err = pool.service.SendRawWithEnvelope(ctx, "gopher@gopherpit.com", []string{"support@gopherpit.com"}, []byte("Subject: test\r\n\r\ntest body\r\n"))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error %v, got %v", context.Canceled, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("send took %s, expected to stop when the context is canceled", d)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("connection not closed")
+	}
+	if got := len(pool.idle); got != 0 {
+		t.Errorf("expected no idle connections, got %v", got)
+	}
+}
+
+func TestPoolConcurrent(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	pool := NewPool(Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}, 3)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := pool.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+				t.Errorf("send email: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := pool.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	commands := recorder.Commands()
+	if got := countCommands(commands, "EHLO"); got > 3 {
+		t.Errorf("expected at most 3 connections, got %v", got)
+	}
+	if got := countCommands(commands, "DATA"); got != 20 {
+		t.Errorf("expected 20 DATA commands, got %v", got)
+	}
+}
+
+func BenchmarkServiceSendEmail(b *testing.B) {
+	recorder, err := newSMTPRecorder(b)
+	if err != nil {
+		b.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+			b.Fatalf("send email: %s", err)
+		}
+	}
+}
+
+func BenchmarkPoolSendEmail(b *testing.B) {
+	recorder, err := newSMTPRecorder(b)
+	if err != nil {
+		b.Fatalf("smtp listen: %s", err)
+	}
+
+	pool := NewPool(Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}, 1)
+	defer pool.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := pool.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+			b.Fatalf("send email: %s", err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import "strconv"
+
+// Priority is the importance of a message for its recipients.
+type Priority int
+
+// Message priorities. The zero value does not set any priority headers.
+const (
+	PriorityLow Priority = iota + 1
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return "priority(" + strconv.Itoa(int(p)) + ")"
+}
+
+// Headers returns X-Priority, Importance and Priority headers for the
+// priority, as different mail clients read different ones. It returns nil
+// for unknown priorities. The result can be passed to methods with headers
+// argument, for example:
+//
+//	service.SendEmailWithHeaders(from, to, subject, body, email.PriorityHigh.Headers())
+func (p Priority) Headers() map[string][]string {
+	var xPriority, priority string
+	switch p {
+	case PriorityLow:
+		xPriority, priority = "5 (Lowest)", "non-urgent"
+	case PriorityNormal:
+		xPriority, priority = "3 (Normal)", "normal"
+	case PriorityHigh:
+		xPriority, priority = "1 (Highest)", "urgent"
+	default:
+		return nil
+	}
+	return map[string][]string{
+		"X-Priority": {xPriority},
+		"Importance": {p.String()},
+		"Priority":   {priority},
+	}
+}
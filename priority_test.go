@@ -0,0 +1,80 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPriorityHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		priority Priority
+		want     map[string][]string
+	}{
+		{
+			priority: PriorityLow,
+			want: map[string][]string{
+				"X-Priority": {"5 (Lowest)"},
+				"Importance": {"low"},
+				"Priority":   {"non-urgent"},
+			},
+		},
+		{
+			priority: PriorityNormal,
+			want: map[string][]string{
+				"X-Priority": {"3 (Normal)"},
+				"Importance": {"normal"},
+				"Priority":   {"normal"},
+			},
+		},
+		{
+			priority: PriorityHigh,
+			want: map[string][]string{
+				"X-Priority": {"1 (Highest)"},
+				"Importance": {"high"},
+				"Priority":   {"urgent"},
+			},
+		},
+		{
+			priority: 0,
+			want:     nil,
+		},
+	} {
+		t.Run(tc.priority.String(), func(t *testing.T) {
+			if got := tc.priority.Headers(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, expected %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestServiceSendPriority(t *testing.T) {
+	transport := new(MemoryTransport)
+	service := Service{
+		Transport: transport,
+	}
+
+	if err := service.Send(&Message{
+		From:     "gopher@gopherpit.com",
+		To:       []string{"support@gopherpit.com"},
+		Subject:  "test subject",
+		TextBody: "test body",
+		Priority: PriorityHigh,
+		Headers: map[string][]string{
+			"Importance": {"low"},
+		},
+	}); err != nil {
+		t.Fatalf("send: %s", err)
+	}
+
+	m := parseSMTPMessage(t, transport.Messages()[0].Data)
+	for field, want := range PriorityHigh.Headers() {
+		if got := m.Header.Get(field); got != want[0] {
+			t.Errorf("header %s: got %q, expected %q", field, got, want[0])
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// sendmail delivers the message content by executing the program at
+// Service.SendmailPath with envelope addresses as arguments and writing the
+// content to its standard input. Recipients are passed explicitly instead of
+// reading them from headers with -t flag, as Bcc header is not written.
+func (s Service) sendmail(ctx context.Context, from string, to []string, content io.WriterTo, opts sendOptions) (int64, error) {
+	if opts.dsn.required() {
+		return 0, ErrDSNUnsupported
+	}
+	args := append([]string{"-i", "-f", from, "--"}, to...)
+	cmd := exec.CommandContext(ctx, s.SendmailPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 0, fmt.Errorf("email: sendmail: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("email: sendmail: %w", err)
+	}
+	n, err := content.WriteTo(stdin)
+	if e := stdin.Close(); err == nil {
+		err = e
+	}
+	if e := cmd.Wait(); e != nil {
+		// The exit status explains a failed write to the closed input.
+		err = e
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if msg := strings.TrimSpace(stderr.String()); msg != "" && errors.As(err, &exitErr) {
+			return n, fmt.Errorf("email: sendmail: %w: %s", err, msg)
+		}
+		return n, fmt.Errorf("email: sendmail: %w", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestSendmail writes a shell script that records its arguments and
+// standard input to files in a temporary directory, and exits with the code.
+func newTestSendmail(t *testing.T, code int) (path, dir string) {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts are not supported")
+	}
+	dir = t.TempDir()
+	path = filepath.Join(dir, "sendmail")
+	script := "#!/bin/sh\n" +
+		`echo "$@" > "` + dir + `/args"` + "\n" +
+		`cat > "` + dir + `/stdin"` + "\n"
+	if code != 0 {
+		script += "echo 'recipient rejected' >&2\nexit " + strconv.Itoa(code) + "\n"
+	}
+	if err := os.WriteFile(path, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return path, dir
+}
+
+func TestServiceSendmail(t *testing.T) {
+	path, dir := newTestSendmail(t, 0)
+
+	service := Service{
+		SendmailPath: path,
+	}
+
+	if err := service.SendEmailFull("gopher@gopherpit.com", []string{"support@gopherpit.com"}, nil, []string{"archive@gopherpit.com"}, "test subject", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(args)), "-i -f gopher@gopherpit.com -- support@gopherpit.com archive@gopherpit.com"; got != want {
+		t.Errorf("got arguments %q, expected %q", got, want)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := parseSMTPMessage(t, data)
+	if m.Subject != "test subject" {
+		t.Errorf("got subject %q, expected %q", m.Subject, "test subject")
+	}
+	if m.Header.Get("Bcc") != "" {
+		t.Errorf("unexpected Bcc header %q", m.Header.Get("Bcc"))
+	}
+}
+
+func TestServiceSendmailExitCode(t *testing.T) {
+	path, _ := newTestSendmail(t, 7)
+
+	service := Service{
+		SendmailPath: path,
+	}
+
+	err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+	var e *SendError
+	if !errors.As(err, &e) || e.Address != path {
+		t.Fatalf("expected SendError with sendmail path, got %v", err)
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 7 {
+		t.Fatalf("expected exit code 7, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "recipient rejected") {
+		t.Errorf("expected error with sendmail output, got %q", err)
+	}
+}
+
+func TestPoolSendmail(t *testing.T) {
+	path, dir := newTestSendmail(t, 0)
+
+	pool := NewPool(Service{
+		SendmailPath: path,
+	}, 1)
+	defer pool.Close()
+
+	if err := pool.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := parseSMTPMessage(t, data); m.Subject != "test subject" {
+		t.Errorf("got subject %q, expected %q", m.Subject, "test subject")
+	}
+}
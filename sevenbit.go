@@ -0,0 +1,112 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// sevenBitData returns the message content with bodies of all parts that have
+// 8bit Content-Transfer-Encoding encoded as quoted-printable, so that it can
+// be sent to SMTP servers that do not support 8BITMIME extension. Other parts
+// are not changed. The whole message is buffered in memory.
+func sevenBitData(content io.WriterTo) (messageData, error) {
+	var src bytes.Buffer
+	if _, err := content.WriteTo(&src); err != nil {
+		return nil, err
+	}
+	var dst bytes.Buffer
+	if err := writeSevenBit(&dst, src.Bytes()); err != nil {
+		return nil, err
+	}
+	return messageData(dst.Bytes()), nil
+}
+
+// writeSevenBit writes the entity, a message or a multipart part with its
+// header, encoding its 8bit body, or the bodies of its nested parts.
+func writeSevenBit(w *bytes.Buffer, entity []byte) error {
+	i := bytes.Index(entity, []byte("\r\n\r\n"))
+	if i < 0 || bytes.HasPrefix(entity, []byte("\r\n")) {
+		// Entity without header fields has the default encoding, 7bit.
+		w.Write(entity)
+		return nil
+	}
+	header, body := entity[:i+2], entity[i+4:]
+	h, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(entity[:i+4]))).ReadMIMEHeader()
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(strings.TrimSpace(h.Get("Content-Transfer-Encoding")), "8bit") {
+		writeHeaderEncoding(w, header, "quoted-printable")
+		w.WriteString("\r\n")
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write(body); err != nil {
+			return err
+		}
+		return qp.Close()
+	}
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		w.Write(entity)
+		return nil
+	}
+	w.Write(header)
+	w.WriteString("\r\n")
+	return writeSevenBitParts(w, body, params["boundary"])
+}
+
+// writeSevenBitParts writes the multipart body with the parts between
+// boundary delimiters written by writeSevenBit.
+func writeSevenBitParts(w *bytes.Buffer, body []byte, boundary string) error {
+	delimiter := []byte("\r\n--" + boundary)
+	// Line break is added as the first delimiter may be at the start of the
+	// body, and it is removed when the body is written.
+	segments := bytes.Split(append([]byte("\r\n"), body...), delimiter)
+	var buf bytes.Buffer
+	buf.Write(segments[0])
+	for _, s := range segments[1:] {
+		buf.Write(delimiter)
+		i := bytes.Index(s, []byte("\r\n"))
+		if bytes.HasPrefix(s, []byte("--")) || i < 0 {
+			// Close delimiter and epilogue.
+			buf.Write(s)
+			continue
+		}
+		buf.Write(s[:i+2])
+		if err := writeSevenBit(&buf, s[i+2:]); err != nil {
+			return err
+		}
+	}
+	w.Write(buf.Bytes()[2:])
+	return nil
+}
+
+// writeHeaderEncoding writes the header lines with the value of
+// Content-Transfer-Encoding field replaced by encoding.
+func writeHeaderEncoding(w *bytes.Buffer, header []byte, encoding string) {
+	var skip bool
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if skip && (line[0] == ' ' || line[0] == '\t') {
+			// Continuation of the replaced field.
+			continue
+		}
+		skip = false
+		if i := strings.IndexByte(line, ':'); i > 0 && strings.EqualFold(strings.TrimSpace(line[:i]), "Content-Transfer-Encoding") {
+			line = "Content-Transfer-Encoding: " + encoding + "\r\n"
+			skip = true
+		}
+		w.WriteString(line)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"strings"
+	"testing"
+
+	"gopkg.in/mail.v2"
+)
+
+func TestSevenBitData(t *testing.T) {
+	text := "Grüße\r\nfrom the gopher\r\n"
+	html := "<p>Grüße</p>"
+
+	m := mail.NewMessage()
+	m.SetHeader("From", "gopher@gopherpit.com")
+	m.SetHeader("To", "support@gopherpit.com")
+	m.SetBody("text/plain", text, mail.SetPartEncoding(mail.Unencoded))
+	m.AddAlternative("text/html", html, mail.SetPartEncoding(mail.Unencoded))
+	if err := attach(m, Attachment{Filename: "notes.txt", ContentType: "text/plain", Data: []byte("notes")}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := sevenBitData(m)
+	if err != nil {
+		t.Fatalf("seven bit data: %s", err)
+	}
+	for _, b := range data {
+		if b >= 0x80 {
+			t.Fatalf("unexpected 8bit data in %s", data)
+		}
+	}
+
+	msg, err := netmail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := make(map[string]string)
+	var walk func(r *multipart.Reader)
+	walk = func(r *multipart.Reader) {
+		for {
+			p, err := r.NextRawPart()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			mediaType, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(mediaType, "multipart/") {
+				walk(multipart.NewReader(p, params["boundary"]))
+				continue
+			}
+			var body io.Reader = p
+			switch p.Header.Get("Content-Transfer-Encoding") {
+			case "quoted-printable":
+				body = quotedprintable.NewReader(p)
+			case "base64":
+			default:
+				t.Errorf("%s: unexpected encoding %q", mediaType, p.Header.Get("Content-Transfer-Encoding"))
+			}
+			b, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Header.Get("Content-Disposition") == "" {
+				parts[mediaType] = string(b)
+			} else {
+				parts["attachment"] = string(b)
+			}
+		}
+	}
+	walk(multipart.NewReader(msg.Body, params["boundary"]))
+
+	for mediaType, want := range map[string]string{
+		"text/plain": text,
+		"text/html":  html,
+		"attachment": "bm90ZXM=",
+	} {
+		if got := parts[mediaType]; got != want {
+			t.Errorf("%s: expected %q, got %q", mediaType, want, got)
+		}
+	}
+}
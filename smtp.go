@@ -0,0 +1,723 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// SMTPError is returned when SMTP server replies with a code that is not
+// expected for the issued command.
+type SMTPError struct {
+	// Command that the server replied to, without arguments that may contain
+	// credentials. It is empty for the server greeting.
+	Command string
+	// Reply code.
+	Code int
+	// Complete reply text. Lines of multiline replies are separated by a new
+	// line character.
+	Message string
+}
+
+func (e *SMTPError) Error() string {
+	if e.Command == "" {
+		return fmt.Sprintf("email: smtp: %d %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("email: smtp %s: %d %s", e.Command, e.Code, e.Message)
+}
+
+// EnhancedCode returns the enhanced mail system status code from the reply
+// text as defined in RFC 3463, for example "5.1.1", or an empty string if the
+// reply does not start with it.
+func (e *SMTPError) EnhancedCode() string {
+	code := strings.SplitN(e.Message, " ", 2)[0]
+	parts := strings.Split(code, ".")
+	if len(parts) != 3 || (parts[0] != "2" && parts[0] != "4" && parts[0] != "5") {
+		return ""
+	}
+	for _, p := range parts[1:] {
+		if len(p) == 0 || len(p) > 3 {
+			return ""
+		}
+		for _, c := range p {
+			if c < '0' || c > '9' {
+				return ""
+			}
+		}
+	}
+	return code
+}
+
+// Bounce classifies the error as a permanent or a transient delivery
+// failure. The class of the enhanced status code is used if it is present in
+// the reply, otherwise the class of the reply code.
+func (e *SMTPError) Bounce() Bounce {
+	class := e.Code / 100
+	if c := e.EnhancedCode(); c != "" {
+		class = int(c[0] - '0')
+	}
+	switch class {
+	case 4:
+		return SoftBounce
+	case 5:
+		return HardBounce
+	}
+	return NoBounce
+}
+
+// Stage is a phase of an SMTP session.
+type Stage string
+
+// SMTP session stages.
+const (
+	// StageDial is connecting to the server, including the greeting and EHLO
+	// command.
+	StageDial Stage = "dial"
+	// StageStartTLS is upgrading the connection with STARTTLS command.
+	StageStartTLS Stage = "starttls"
+	// StageAuth is authentication.
+	StageAuth Stage = "auth"
+	// StageMailFrom is MAIL FROM command.
+	StageMailFrom Stage = "mailfrom"
+	// StageRcpt is RCPT TO command.
+	StageRcpt Stage = "rcpt"
+	// StageData is DATA command and sending of the message content.
+	StageData Stage = "data"
+)
+
+// SendError is returned when a message can not be sent to the SMTP server. It
+// wraps the underlying error, which can be SMTPError for unexpected SMTP
+// replies, or a network error.
+type SendError struct {
+	// Network address of the SMTP server, or the path of the sendmail program
+	// if Service.SendmailPath is set.
+	Address string
+	// Stage of the SMTP session in which the error occurred. It is empty if
+	// the session was terminated because the context was done.
+	Stage Stage
+	// Reply code if the error is caused by an unexpected SMTP reply, or zero
+	// otherwise.
+	Code int
+	// The underlying error.
+	Err error
+}
+
+func (e *SendError) Error() string {
+	// Address is not known for custom transports.
+	source := strings.TrimSpace(e.Address + " " + string(e.Stage))
+	if source == "" {
+		return fmt.Sprintf("email: %v", e.Err)
+	}
+	return fmt.Sprintf("email: %s: %v", source, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// IsTemporary reports whether the error is a transient failure after which
+// sending may be retried. These are 4xx SMTP replies and network errors, but
+// not 5xx SMTP replies or TLS verification failures.
+func (e *SendError) IsTemporary() bool {
+	var smtpErr *SMTPError
+	if errors.As(e.Err, &smtpErr) {
+		return smtpErr.Bounce() == SoftBounce
+	}
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) || errors.Is(e.Err, io.EOF) || errors.Is(e.Err, io.ErrUnexpectedEOF)
+}
+
+// stageError returns SendError for the stage, or nil if err is nil.
+func stageError(stage Stage, err error) error {
+	if err == nil {
+		return nil
+	}
+	e := &SendError{
+		Stage: stage,
+		Err:   err,
+	}
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		e.Code = smtpErr.Code
+	}
+	return e
+}
+
+// Bounce is a classification of a delivery failure.
+type Bounce int
+
+// Bounce classifications.
+const (
+	// NoBounce is the classification of a reply which does not reject the
+	// message.
+	NoBounce Bounce = iota
+	// SoftBounce is a transient failure after which sending to the same
+	// recipient may be retried.
+	SoftBounce
+	// HardBounce is a permanent failure after which the recipient should not
+	// be retried.
+	HardBounce
+)
+
+func (b Bounce) String() string {
+	switch b {
+	case NoBounce:
+		return "no bounce"
+	case SoftBounce:
+		return "soft bounce"
+	case HardBounce:
+		return "hard bounce"
+	}
+	return "bounce(" + strconv.Itoa(int(b)) + ")"
+}
+
+// ErrUnexpectedBanner is returned when the SMTP server greeting does not
+// match Service.SMTPExpectBanner.
+var ErrUnexpectedBanner = errors.New("email: unexpected smtp server banner")
+
+// ErrInsecureAuth is returned when SMTP authentication is required over a
+// connection which is not encrypted and Service.SMTPAllowInsecureAuth is not
+// set.
+var ErrInsecureAuth = errors.New("email: smtp authentication over unencrypted connection")
+
+// ErrStartTLSUnsupported is returned when STARTTLS is required, but the SMTP
+// server does not support it.
+var ErrStartTLSUnsupported = errors.New("email: smtp server does not support starttls")
+
+// ErrSMTPUTF8Unsupported is returned when an address has a local part with
+// non-ASCII characters and the SMTP server does not support SMTPUTF8
+// extension.
+var ErrSMTPUTF8Unsupported = errors.New("email: smtp server does not support smtputf8")
+
+// sendOptions are delivery options of a single message.
+type sendOptions struct {
+	// Delivery status notifications requested for the message.
+	dsn DSN
+	// Address header fields of the message have non-ASCII local parts,
+	// which can be sent only with SMTPUTF8 extension.
+	utf8Headers bool
+}
+
+// replyCodes defines which reply codes are accepted for a command. A code is
+// accepted if its first digit is equal to class, when class is not zero, and
+// if it is one of codes, when codes are provided.
+type replyCodes struct {
+	class int
+	codes []int
+}
+
+func (r replyCodes) match(code int) bool {
+	if r.class != 0 && code/100 != r.class {
+		return false
+	}
+	if len(r.codes) == 0 {
+		return true
+	}
+	for _, c := range r.codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	replyGreeting = replyCodes{class: 2, codes: []int{220}}
+	replyOK       = replyCodes{class: 2}
+	replyData     = replyCodes{class: 3, codes: []int{354}}
+	replyAuth     = replyCodes{codes: []int{235, 334}}
+	replyAny      = replyCodes{}
+)
+
+// smtpClient is an SMTP client connection that checks every server reply
+// against the codes that are expected for the issued command.
+type smtpClient struct {
+	conn net.Conn
+	text *textproto.Conn
+	host string
+	tls  bool
+	ext  map[string]string
+	// Text of the server greeting reply.
+	greeting string
+	// Optional function that writes command lines.
+	format func(verb, params string) string
+	// Time when the connection was returned to Pool idle connections.
+	idleSince time.Time
+	// Whether messages are sent with 8bit body.
+	eightBit bool
+}
+
+// newSMTPClient returns a new client on an established connection and reads
+// the server greeting. Host is used as the server name for authentication.
+func newSMTPClient(conn net.Conn, host string) (*smtpClient, error) {
+	c := &smtpClient{
+		conn: conn,
+		text: textproto.NewConn(conn),
+		host: host,
+	}
+	_, c.tls = conn.(*tls.Conn)
+	_, msg, err := c.reply("", replyGreeting)
+	if err != nil {
+		c.text.Close()
+		return nil, err
+	}
+	c.greeting = msg
+	return c, nil
+}
+
+// cmd sends a command and reads the reply, returning SMTPError if the reply
+// code is not expected.
+func (c *smtpClient) cmd(expect replyCodes, format string, args ...interface{}) (int, string, error) {
+	parts := strings.SplitN(fmt.Sprintf(format, args...), " ", 2)
+	var params string
+	if len(parts) > 1 {
+		params = parts[1]
+	}
+	return c.command(parts[0], expect, c.line(parts[0], params))
+}
+
+// line returns the command line for the command verb and its parameters.
+func (c *smtpClient) line(verb, params string) string {
+	if c.format != nil {
+		return c.format(verb, params)
+	}
+	if params == "" {
+		return verb
+	}
+	return verb + " " + params
+}
+
+// command sends a command line and reads the reply. Name is used to identify
+// the command in errors instead of the line which may contain sensitive data.
+func (c *smtpClient) command(name string, expect replyCodes, line string) (int, string, error) {
+	id, err := c.text.Cmd("%s", line)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.reply(name, expect)
+}
+
+func (c *smtpClient) reply(name string, expect replyCodes) (int, string, error) {
+	code, msg, err := c.text.ReadResponse(0)
+	if err != nil {
+		return code, msg, err
+	}
+	if !expect.match(code) {
+		return code, msg, &SMTPError{
+			Command: name,
+			Code:    code,
+			Message: msg,
+		}
+	}
+	return code, msg, nil
+}
+
+// hello sends EHLO command, falling back to HELO if the server does not
+// support it.
+func (c *smtpClient) hello(name string) error {
+	_, msg, err := c.cmd(replyOK, "EHLO %s", name)
+	if err != nil {
+		var e *SMTPError
+		if errors.As(err, &e) && e.Code/100 == 5 {
+			_, _, err = c.cmd(replyOK, "HELO %s", name)
+		}
+		c.ext = nil
+		return err
+	}
+	c.ext = make(map[string]string)
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		args := strings.SplitN(line, " ", 2)
+		if len(args) > 1 {
+			c.ext[strings.ToUpper(args[0])] = args[1]
+		} else {
+			c.ext[strings.ToUpper(args[0])] = ""
+		}
+	}
+	return nil
+}
+
+// extension reports whether the server supports an extension and returns
+// its parameters.
+func (c *smtpClient) extension(name string) (bool, string) {
+	if c.ext == nil {
+		return false, ""
+	}
+	params, ok := c.ext[strings.ToUpper(name)]
+	return ok, params
+}
+
+// startTLS upgrades the connection to TLS and sends EHLO command again, as
+// the server forgets the previously announced extensions. EHLO is sent after
+// the delay, if it is not zero, or returns an error if the context is done
+// before it elapses.
+func (c *smtpClient) startTLS(ctx context.Context, config *tls.Config, name string, delay time.Duration) error {
+	if _, _, err := c.cmd(replyGreeting, "STARTTLS"); err != nil {
+		return err
+	}
+	conn := tls.Client(c.conn, config)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = conn
+	c.text = textproto.NewConn(conn)
+	c.tls = true
+	if delay > 0 {
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+	return c.hello(name)
+}
+
+// auth authenticates the client using the provided mechanism.
+func (c *smtpClient) auth(a smtp.Auth) error {
+	_, mechanisms := c.extension("AUTH")
+	mech, resp, err := a.Start(&smtp.ServerInfo{
+		Name: c.host,
+		TLS:  c.tls,
+		Auth: strings.Fields(mechanisms),
+	})
+	if err != nil {
+		return err
+	}
+	name := "AUTH " + mech
+	code, msg, err := c.command(name, replyAuth, c.line("AUTH", strings.TrimSpace(mech+" "+encodeAuth(resp))))
+	for err == nil {
+		var challenge []byte
+		if code == 334 {
+			challenge, err = base64.StdEncoding.DecodeString(msg)
+		} else {
+			// The last message is not base64 encoded as it is not a challenge.
+			challenge = []byte(msg)
+		}
+		if err == nil {
+			resp, err = a.Next(challenge, code == 334)
+		}
+		if err != nil {
+			// Abort the authentication exchange.
+			_, _, _ = c.command(name, replyAny, "*")
+			return err
+		}
+		if resp == nil {
+			return nil
+		}
+		code, msg, err = c.command(name, replyAuth, encodeAuth(resp))
+	}
+	return err
+}
+
+func encodeAuth(b []byte) string {
+	if b == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// sendMail submits the message content to recipients in a single mail
+// transaction and returns the size of the content.
+//
+// Addresses with non-ASCII characters are sent with SMTPUTF8 parameter, as
+// defined in RFC 6531, if the server supports it. Otherwise, their domains
+// are converted to IDNA ASCII form and ErrSMTPUTF8Unsupported is returned for
+// non-ASCII local parts, also if they are only in the message headers.
+//
+// Delivery status notifications are requested with the DSN options if the
+// server supports them.
+func (c *smtpClient) sendMail(from string, to []string, content io.WriterTo, opts sendOptions) (int64, error) {
+	var params, rcptParams string
+	dsn := opts.dsn
+	if dsn.requested() {
+		if ok, _ := c.extension("DSN"); ok {
+			params = dsn.mailParams()
+			rcptParams = dsn.rcptParams()
+		} else if dsn.Required {
+			return 0, stageError(StageMailFrom, ErrDSNUnsupported)
+		}
+	}
+	if c.eightBit {
+		if ok, _ := c.extension("8BITMIME"); ok {
+			params += " BODY=8BITMIME"
+		} else {
+			data, err := sevenBitData(content)
+			if err != nil {
+				return 0, stageError(StageData, err)
+			}
+			content = data
+		}
+	}
+	if !isASCII(from) || !allASCII(to) || opts.utf8Headers {
+		if ok, _ := c.extension("SMTPUTF8"); ok {
+			params += " SMTPUTF8"
+		} else {
+			var err error
+			if from, err = asciiAddress(from); err != nil {
+				return 0, stageError(StageMailFrom, err)
+			}
+			ascii := make([]string, len(to))
+			for i, addr := range to {
+				if ascii[i], err = asciiAddress(addr); err != nil {
+					return 0, stageError(StageRcpt, err)
+				}
+			}
+			to = ascii
+			if opts.utf8Headers {
+				return 0, stageError(StageMailFrom, fmt.Errorf("%w: non-ASCII address in message headers", ErrSMTPUTF8Unsupported))
+			}
+		}
+	}
+	if ok, _ := c.extension("PIPELINING"); ok {
+		if err := c.pipelineEnvelope(from, params, to, rcptParams); err != nil {
+			return 0, err
+		}
+	} else {
+		if err := c.mail(from, params); err != nil {
+			return 0, stageError(StageMailFrom, err)
+		}
+		for _, addr := range to {
+			if err := c.rcpt(addr, rcptParams); err != nil {
+				return 0, stageError(StageRcpt, err)
+			}
+		}
+	}
+	w, err := c.data()
+	if err != nil {
+		return 0, stageError(StageData, err)
+	}
+	n, err := content.WriteTo(w)
+	if err != nil {
+		return n, stageError(StageData, err)
+	}
+	return n, stageError(StageData, w.Close())
+}
+
+func (c *smtpClient) mail(from, params string) error {
+	_, _, err := c.cmd(replyOK, "MAIL FROM:<%s>%s", from, params)
+	return err
+}
+
+func (c *smtpClient) rcpt(to, params string) error {
+	_, _, err := c.cmd(replyOK, "RCPT TO:<%s>%s", to, params)
+	return err
+}
+
+// pipelineEnvelope sends MAIL and all RCPT commands at once, and then reads
+// their replies, as defined in RFC 2920, instead of waiting for a reply to
+// every command. All replies are read to keep the session usable, and the
+// first error is returned, as SendError with the stage of its command.
+func (c *smtpClient) pipelineEnvelope(from, params string, to []string, rcptParams string) error {
+	id := c.text.Next()
+	c.text.StartRequest(id)
+	_, _ = c.text.W.WriteString(c.line("MAIL", "FROM:<"+from+">"+params) + "\r\n")
+	for _, addr := range to {
+		_, _ = c.text.W.WriteString(c.line("RCPT", "TO:<"+addr+">"+rcptParams) + "\r\n")
+	}
+	err := c.text.W.Flush()
+	c.text.EndRequest(id)
+	if err != nil {
+		return stageError(StageMailFrom, err)
+	}
+
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	if _, _, err = c.reply("MAIL", replyOK); err != nil {
+		var e *SMTPError
+		if !errors.As(err, &e) {
+			return stageError(StageMailFrom, err)
+		}
+		err = stageError(StageMailFrom, err)
+	}
+	for range to {
+		_, _, rerr := c.reply("RCPT", replyOK)
+		if rerr == nil {
+			continue
+		}
+		var e *SMTPError
+		if !errors.As(rerr, &e) {
+			return stageError(StageRcpt, rerr)
+		}
+		if err == nil {
+			err = stageError(StageRcpt, rerr)
+		}
+	}
+	return err
+}
+
+// asciiAddress returns the address with the domain converted to IDNA ASCII
+// form. ErrSMTPUTF8Unsupported is returned if the local part contains
+// non-ASCII characters.
+func asciiAddress(addr string) (string, error) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 || !isASCII(addr[:i]) {
+		return "", fmt.Errorf("%w: %q", ErrSMTPUTF8Unsupported, addr)
+	}
+	return idnaAddress(addr)
+}
+
+// idnaAddress returns the address with the domain converted to IDNA ASCII
+// form, keeping the local part unchanged.
+func idnaAddress(addr string) (string, error) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 || isASCII(addr[i+1:]) {
+		return addr, nil
+	}
+	domain, err := idna.Lookup.ToASCII(addr[i+1:])
+	if err != nil {
+		return "", fmt.Errorf("email: domain of address %q: %w", addr, err)
+	}
+	return addr[:i+1] + domain, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func allASCII(s []string) bool {
+	for _, v := range s {
+		if !isASCII(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// data issues DATA command and returns a writer for the message content.
+// The message is submitted when the writer is closed.
+func (c *smtpClient) data() (io.WriteCloser, error) {
+	if _, _, err := c.cmd(replyData, "DATA"); err != nil {
+		return nil, err
+	}
+	return &dataWriter{c: c, WriteCloser: c.text.DotWriter()}, nil
+}
+
+type dataWriter struct {
+	c *smtpClient
+	io.WriteCloser
+}
+
+func (w *dataWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	_, _, err := w.c.reply("DATA", replyOK)
+	return err
+}
+
+func (c *smtpClient) reset() error {
+	_, _, err := c.cmd(replyOK, "RSET")
+	return err
+}
+
+func (c *smtpClient) quit() error {
+	_, _, err := c.cmd(replyOK, "QUIT")
+	if cerr := c.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *smtpClient) close() error {
+	return c.text.Close()
+}
+
+// loginAuth implements LOGIN authentication mechanism.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("email: unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("email: wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSuffix(string(fromServer), ":")) {
+	case "username":
+		return []byte(a.username), nil
+	case "password":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("email: unexpected server challenge: %s", fromServer)
+}
+
+// OAuth2Auth returns an smtp.Auth that implements XOAUTH2 mechanism, used by
+// Gmail and Office 365, which authenticates the user with an OAuth 2.0 access
+// token instead of a password. It can be used as Service.SMTPAuth. The token
+// is sent only over TLS connections or to localhost.
+func OAuth2Auth(username, token string) smtp.Auth {
+	return &oauth2Auth{
+		username: username,
+		token:    token,
+	}
+}
+
+type oauth2Auth struct {
+	username string
+	token    string
+}
+
+func (a *oauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("email: unencrypted connection")
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *oauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	// Server continues with an error description in JSON format instead of
+	// rejecting the token right away.
+	return nil, fmt.Errorf("email: xoauth2: %s", fromServer)
+}
+
+// insecureAuth allows authentication mechanisms which require TLS to be used
+// over connections that are not encrypted.
+type insecureAuth struct {
+	smtp.Auth
+}
+
+func (a insecureAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	info := *server
+	info.TLS = true
+	return a.Auth.Start(&info)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -0,0 +1,1276 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServiceReplyCodes(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		replies map[string]string
+		wantErr *SMTPError
+	}{
+		{
+			name: "standard",
+		},
+		{
+			name: "varied",
+			replies: map[string]string{
+				"EHLO": "250 gopherpit.com greets you\n250 8BITMIME\n250 SIZE 10240000",
+				"MAIL": "251 2.1.0 Sender ok",
+				"RCPT": "251 2.1.5 User not local; will forward",
+				"QUIT": "250 2.0.0 Bye",
+			},
+		},
+		{
+			name: "rejected sender",
+			replies: map[string]string{
+				"MAIL": "451 4.3.0 Try again later",
+			},
+			wantErr: &SMTPError{Command: "MAIL", Code: 451, Message: "4.3.0 Try again later"},
+		},
+		{
+			name: "rejected recipient multiline",
+			replies: map[string]string{
+				"RCPT": "550 5.1.1 User unknown\n550 5.1.1 Mailbox does not exist",
+			},
+			wantErr: &SMTPError{Command: "RCPT", Code: 550, Message: "5.1.1 User unknown\n5.1.1 Mailbox does not exist"},
+		},
+		{
+			name: "unexpected data reply",
+			replies: map[string]string{
+				"DATA": "250 OK",
+			},
+			wantErr: &SMTPError{Command: "DATA", Code: 250, Message: "OK"},
+		},
+		{
+			name: "unexpected hello reply",
+			replies: map[string]string{
+				"EHLO": "354 Go ahead",
+			},
+			wantErr: &SMTPError{Command: "EHLO", Code: 354, Message: "Go ahead"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder, err := newSMTPRecorder(t)
+			if err != nil {
+				t.Fatalf("smtp listen: %s", err)
+			}
+			for verb, reply := range tc.replies {
+				recorder.SetReply(verb, reply)
+			}
+
+			service := Service{
+				SMTPHost: "localhost",
+				SMTPPort: recorder.Port,
+			}
+
+			err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+			if tc.wantErr == nil {
+				if err != nil {
+					t.Fatalf("send email: %s", err)
+				}
+				if recorder.Message() == nil {
+					t.Error("message not recorded")
+				}
+				return
+			}
+			var e *SMTPError
+			if !errors.As(err, &e) {
+				t.Fatalf("expected smtp error, got %#v", err)
+			}
+			if *e != *tc.wantErr {
+				t.Errorf("expected error %#v, got %#v", tc.wantErr, e)
+			}
+		})
+	}
+}
+
+func TestServiceErrorAddress(t *testing.T) {
+	t.Run("protocol", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+		recorder.SetReply("MAIL", "550 5.7.1 Sender rejected")
+
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: recorder.Port,
+		}
+
+		err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if want := "localhost:" + strconv.Itoa(recorder.Port); !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error %q to contain %q", err, want)
+		}
+		var e *SMTPError
+		if !errors.As(err, &e) {
+			t.Errorf("expected smtp error, got %#v", err)
+		}
+	})
+
+	t.Run("connection", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %s", err)
+		}
+		addr := ln.Addr().String()
+		ln.Close()
+
+		service := Service{
+			SMTPHost: "127.0.0.1",
+			SMTPPort: ln.Addr().(*net.TCPAddr).Port,
+		}
+
+		err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if !strings.Contains(err.Error(), addr) {
+			t.Errorf("expected error %q to contain %q", err, addr)
+		}
+		var e *net.OpError
+		if !errors.As(err, &e) {
+			t.Errorf("expected network error, got %#v", err)
+		}
+	})
+}
+
+func TestReplyCodesMatch(t *testing.T) {
+	for _, tc := range []struct {
+		codes replyCodes
+		code  int
+		want  bool
+	}{
+		{codes: replyOK, code: 250, want: true},
+		{codes: replyOK, code: 251, want: true},
+		{codes: replyOK, code: 221, want: true},
+		{codes: replyOK, code: 354, want: false},
+		{codes: replyOK, code: 550, want: false},
+		{codes: replyGreeting, code: 220, want: true},
+		{codes: replyGreeting, code: 250, want: false},
+		{codes: replyGreeting, code: 554, want: false},
+		{codes: replyData, code: 354, want: true},
+		{codes: replyData, code: 350, want: false},
+		{codes: replyAuth, code: 235, want: true},
+		{codes: replyAuth, code: 334, want: true},
+		{codes: replyAuth, code: 535, want: false},
+		{codes: replyAny, code: 421, want: true},
+	} {
+		if got := tc.codes.match(tc.code); got != tc.want {
+			t.Errorf("%+v match %v: expected %v, got %v", tc.codes, tc.code, tc.want, got)
+		}
+	}
+}
+
+func TestServiceBounce(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		reply        string
+		enhancedCode string
+		want         Bounce
+	}{
+		{
+			name:         "mailbox full",
+			reply:        "452 4.2.2 Mailbox full",
+			enhancedCode: "4.2.2",
+			want:         SoftBounce,
+		},
+		{
+			name:         "user unknown",
+			reply:        "550 5.1.1 User unknown",
+			enhancedCode: "5.1.1",
+			want:         HardBounce,
+		},
+		{
+			name:  "greylisted without enhanced code",
+			reply: "450 Greylisted, try again later",
+			want:  SoftBounce,
+		},
+		{
+			name:  "rejected without enhanced code",
+			reply: "554 Rejected",
+			want:  HardBounce,
+		},
+		{
+			name:         "enhanced code takes precedence",
+			reply:        "550 4.7.1 Temporarily rejected",
+			enhancedCode: "4.7.1",
+			want:         SoftBounce,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder, err := newSMTPRecorder(t)
+			if err != nil {
+				t.Fatalf("smtp listen: %s", err)
+			}
+			recorder.SetReply("RCPT", tc.reply)
+
+			service := Service{
+				SMTPHost: "localhost",
+				SMTPPort: recorder.Port,
+			}
+
+			err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+			var e *SMTPError
+			if !errors.As(err, &e) {
+				t.Fatalf("expected smtp error, got %#v", err)
+			}
+			if got := e.EnhancedCode(); got != tc.enhancedCode {
+				t.Errorf("expected enhanced code %q, got %q", tc.enhancedCode, got)
+			}
+			if got := e.Bounce(); got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestServiceExpectBanner(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+	recorder.SetReply("", "220-mx.gopherpit.com ESMTP ready\n220 No UCE")
+
+	for _, tc := range []struct {
+		name    string
+		banner  *regexp.Regexp
+		wantErr error
+	}{
+		{
+			name:   "match",
+			banner: regexp.MustCompile(`^mx\.gopherpit\.com\b`),
+		},
+		{
+			name:    "mismatch",
+			banner:  regexp.MustCompile(`^smtp\.gopherpit\.com\b`),
+			wantErr: ErrUnexpectedBanner,
+		},
+		{
+			name: "not set",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder.SetMessage(nil)
+
+			service := Service{
+				SMTPHost:         "localhost",
+				SMTPPort:         recorder.Port,
+				SMTPExpectBanner: tc.banner,
+			}
+
+			err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if sent := recorder.Message() != nil; sent != (tc.wantErr == nil) {
+				t.Errorf("expected message sent %v, got %v", tc.wantErr == nil, sent)
+			}
+		})
+	}
+}
+
+func TestServiceCommandFormatter(t *testing.T) {
+	recorder, err := newSMTPRecorder(t, "AUTH PLAIN")
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost:     "localhost",
+		SMTPPort:     recorder.Port,
+		SMTPIdentity: "localhost",
+		SMTPUsername: "gopher",
+		SMTPPassword: "secret",
+		SMTPCommandFormatter: func(verb, params string) string {
+			return strings.TrimSpace(strings.ToLower(verb) + " " + params)
+		},
+	}
+
+	if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	want := []string{
+		"ehlo localhost",
+		"auth PLAIN AGdvcGhlcgBzZWNyZXQ=",
+		"mail FROM:<gopher@gopherpit.com>",
+		"rcpt TO:<support@gopherpit.com>",
+		"data",
+		"quit",
+	}
+	got := recorder.Commands()
+	if len(got) != len(want) {
+		t.Fatalf("expected commands %q, got %q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("command %v: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestServiceStartTLS(t *testing.T) {
+	recorder, err := newSMTPRecorder(t, "AUTH PLAIN")
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+	recorder.SetTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, -1)},
+	})
+
+	service := Service{
+		SMTPHost:          "localhost",
+		SMTPPort:          recorder.Port,
+		SMTPSkipVerify:    true,
+		SMTPUsername:      "gopher",
+		SMTPPassword:      "secret",
+		SMTPStartTLSDelay: 50 * time.Millisecond,
+	}
+
+	start := time.Now()
+	if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+	if d := time.Since(start); d < service.SMTPStartTLSDelay {
+		t.Errorf("expected send to take at least %v, got %v", service.SMTPStartTLSDelay, d)
+	}
+
+	want := []string{"EHLO ", "STARTTLS", "EHLO ", "AUTH"}
+	got := recorder.Commands()
+	if len(got) < len(want) {
+		t.Fatalf("expected commands to start with %q, got %q", want, got)
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("command %v: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+
+	// Waiting after STARTTLS stops when the context is done.
+	service.SMTPStartTLSDelay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	err = service.SendRawWithEnvelope(ctx, "gopher@gopherpit.com", []string{"support@gopherpit.com"}, []byte("Subject: test subject\r\n\r\ntest body\r\n"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("send took %s, expected to stop at the context deadline", d)
+	}
+}
+
+func TestServiceTLSConfigFunc(t *testing.T) {
+	cert := newTestCertificate(t, -1)
+	ca, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	errConfig := errors.New("test config error")
+
+	for _, tc := range []struct {
+		name       string
+		configFunc func(host string) (*tls.Config, error)
+		wantErr    bool
+	}{
+		{
+			name: "host config",
+			configFunc: func(host string) (*tls.Config, error) {
+				if host != "localhost" {
+					return nil, fmt.Errorf("unexpected host %q", host)
+				}
+				return &tls.Config{
+					ServerName: host,
+					RootCAs:    roots,
+				}, nil
+			},
+		},
+		{
+			name: "without server name",
+			configFunc: func(string) (*tls.Config, error) {
+				return &tls.Config{
+					RootCAs: roots,
+				}, nil
+			},
+		},
+		{
+			name:    "not set",
+			wantErr: true,
+		},
+		{
+			name: "error",
+			configFunc: func(string) (*tls.Config, error) {
+				return nil, errConfig
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder, err := newSMTPRecorder(t)
+			if err != nil {
+				t.Fatalf("smtp listen: %s", err)
+			}
+			recorder.SetTLSConfig(&tls.Config{
+				Certificates: []tls.Certificate{cert},
+			})
+
+			service := Service{
+				SMTPHost:          "localhost",
+				SMTPPort:          recorder.Port,
+				SMTPTLSConfigFunc: tc.configFunc,
+			}
+
+			err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if tc.configFunc != nil && !errors.Is(err, errConfig) {
+					t.Errorf("expected error %v, got %v", errConfig, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("send email: %s", err)
+			}
+			if recorder.Message() == nil {
+				t.Error("message not recorded")
+			}
+		})
+	}
+}
+
+func TestServiceTLSConfig(t *testing.T) {
+	cert := newTestCertificate(t, -1)
+	ca, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		recorder func(t *testing.T) (*smtpRecorder, error)
+		implicit bool
+	}{
+		{
+			name: "starttls",
+			recorder: func(t *testing.T) (*smtpRecorder, error) {
+				recorder, err := newSMTPRecorder(t)
+				if err == nil {
+					recorder.SetTLSConfig(serverConfig)
+				}
+				return recorder, err
+			},
+		},
+		{
+			name: "implicit",
+			recorder: func(t *testing.T) (*smtpRecorder, error) {
+				return newSMTPSRecorder(t, serverConfig)
+			},
+			implicit: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, config := range []*tls.Config{
+				{RootCAs: roots, ServerName: "localhost"},
+				{RootCAs: roots, ServerName: "other.gopherpit.com"},
+				nil,
+			} {
+				recorder, err := tc.recorder(t)
+				if err != nil {
+					t.Fatalf("smtp listen: %s", err)
+				}
+
+				service := Service{
+					SMTPHost:        "127.0.0.1",
+					SMTPPort:        recorder.Port,
+					SMTPImplicitTLS: tc.implicit,
+					SMTPTLSConfig:   config,
+				}
+
+				err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+				if wantErr := config == nil || config.ServerName != "localhost"; wantErr {
+					if err == nil {
+						t.Errorf("expected error with config %v", config)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("send email: %s", err)
+				}
+				if recorder.Message() == nil {
+					t.Error("message not recorded")
+				}
+			}
+		})
+	}
+}
+
+func TestServiceSendError(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		replies       map[string]string
+		auth          bool
+		tls           bool
+		wantStage     Stage
+		wantCode      int
+		wantTemporary bool
+	}{
+		{
+			name:          "starttls",
+			replies:       map[string]string{"STARTTLS": "454 4.7.0 TLS not available"},
+			tls:           true,
+			wantStage:     StageStartTLS,
+			wantCode:      454,
+			wantTemporary: true,
+		},
+		{
+			name:      "auth",
+			replies:   map[string]string{"AUTH": "535 5.7.8 Authentication credentials invalid"},
+			auth:      true,
+			wantStage: StageAuth,
+			wantCode:  535,
+		},
+		{
+			name:      "mail from",
+			replies:   map[string]string{"MAIL": "550 5.7.1 Sender rejected"},
+			wantStage: StageMailFrom,
+			wantCode:  550,
+		},
+		{
+			name:          "rcpt",
+			replies:       map[string]string{"RCPT": "450 4.2.1 Mailbox busy"},
+			wantStage:     StageRcpt,
+			wantCode:      450,
+			wantTemporary: true,
+		},
+		{
+			name:      "data",
+			replies:   map[string]string{"DATA": "554 5.3.4 Message too big"},
+			wantStage: StageData,
+			wantCode:  554,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var extensions []string
+			if tc.auth {
+				extensions = append(extensions, "AUTH PLAIN")
+			}
+			recorder, err := newSMTPRecorder(t, extensions...)
+			if err != nil {
+				t.Fatalf("smtp listen: %s", err)
+			}
+			if tc.tls {
+				recorder.SetTLSConfig(&tls.Config{
+					Certificates: []tls.Certificate{newTestCertificate(t, -1)},
+				})
+			}
+			for verb, reply := range tc.replies {
+				recorder.SetReply(verb, reply)
+			}
+
+			service := Service{
+				SMTPHost: "localhost",
+				SMTPPort: recorder.Port,
+			}
+			if tc.auth {
+				service.SMTPUsername = "gopher"
+				service.SMTPPassword = "secret"
+			}
+
+			err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+			var e *SendError
+			if !errors.As(err, &e) {
+				t.Fatalf("expected send error, got %#v", err)
+			}
+			if e.Stage != tc.wantStage {
+				t.Errorf("expected stage %q, got %q", tc.wantStage, e.Stage)
+			}
+			if e.Code != tc.wantCode {
+				t.Errorf("expected code %v, got %v", tc.wantCode, e.Code)
+			}
+			if e.IsTemporary() != tc.wantTemporary {
+				t.Errorf("expected temporary %v, got %v", tc.wantTemporary, e.IsTemporary())
+			}
+			if want := "localhost:" + strconv.Itoa(recorder.Port); e.Address != want {
+				t.Errorf("expected address %q, got %q", want, e.Address)
+			}
+		})
+	}
+
+	t.Run("dial", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %s", err)
+		}
+		ln.Close()
+
+		service := Service{
+			SMTPHost: "127.0.0.1",
+			SMTPPort: ln.Addr().(*net.TCPAddr).Port,
+		}
+
+		err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+		var e *SendError
+		if !errors.As(err, &e) {
+			t.Fatalf("expected send error, got %#v", err)
+		}
+		if e.Stage != StageDial {
+			t.Errorf("expected stage %q, got %q", StageDial, e.Stage)
+		}
+		if e.Code != 0 {
+			t.Errorf("expected no code, got %v", e.Code)
+		}
+		if !e.IsTemporary() {
+			t.Error("expected temporary error")
+		}
+	})
+}
+
+func TestServiceSMTPUTF8(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		extensions []string
+		to         string
+		headers    map[string][]string
+		wantMail   string
+		wantRcpt   string
+		wantTo     string
+		wantErr    error
+		wantStage  Stage
+	}{
+		{
+			name:       "supported",
+			extensions: []string{"SMTPUTF8"},
+			to:         "müller@exämple.de",
+			wantMail:   "MAIL FROM:<gopher@gopherpit.com> SMTPUTF8",
+			wantRcpt:   "RCPT TO:<müller@xn--exmple-cua.de>",
+			wantTo:     "To: müller@xn--exmple-cua.de\r\n",
+		},
+		{
+			name:     "idna domain",
+			to:       "mueller@exämple.de",
+			wantMail: "MAIL FROM:<gopher@gopherpit.com>",
+			wantRcpt: "RCPT TO:<mueller@xn--exmple-cua.de>",
+			wantTo:   "To: mueller@xn--exmple-cua.de\r\n",
+		},
+		{
+			name:     "ascii",
+			to:       "support@gopherpit.com",
+			wantMail: "MAIL FROM:<gopher@gopherpit.com>",
+			wantRcpt: "RCPT TO:<support@gopherpit.com>",
+			wantTo:   "To: support@gopherpit.com\r\n",
+		},
+		{
+			name:      "unsupported local part",
+			to:        "müller@exämple.de",
+			wantErr:   ErrSMTPUTF8Unsupported,
+			wantStage: StageRcpt,
+		},
+		{
+			name:      "unsupported local part in headers",
+			to:        "support@gopherpit.com",
+			headers:   map[string][]string{"Reply-To": {"müller@exämple.de"}},
+			wantErr:   ErrSMTPUTF8Unsupported,
+			wantStage: StageMailFrom,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder, err := newSMTPRecorder(t, tc.extensions...)
+			if err != nil {
+				t.Fatalf("smtp listen: %s", err)
+			}
+
+			service := Service{
+				SMTPHost: "localhost",
+				SMTPPort: recorder.Port,
+			}
+
+			err = service.SendEmailWithHeaders("gopher@gopherpit.com", []string{tc.to}, "test subject", "test body", tc.headers)
+			if tc.wantErr != nil {
+				var e *SendError
+				if !errors.Is(err, tc.wantErr) || !errors.As(err, &e) || e.Stage != tc.wantStage {
+					t.Fatalf("expected error %v at stage %v, got %v", tc.wantErr, tc.wantStage, err)
+				}
+				if commands := recorder.Commands(); countCommands(commands, "MAIL") != 0 {
+					t.Errorf("unexpected commands %q", commands)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("send email: %s", err)
+			}
+
+			commands := recorder.Commands()
+			var mail, rcpt string
+			for _, c := range commands {
+				switch {
+				case strings.HasPrefix(c, "MAIL "):
+					mail = c
+				case strings.HasPrefix(c, "RCPT "):
+					rcpt = c
+				}
+			}
+			if mail != tc.wantMail {
+				t.Errorf("got %q, expected %q", mail, tc.wantMail)
+			}
+			if rcpt != tc.wantRcpt {
+				t.Errorf("got %q, expected %q", rcpt, tc.wantRcpt)
+			}
+			if m := recorder.Message(); m == nil || !bytes.Contains(m.Data, []byte(tc.wantTo)) {
+				t.Errorf("expected header %q in message %+v", tc.wantTo, m)
+			}
+		})
+	}
+}
+
+func TestServiceSMTPUTF8Headers(t *testing.T) {
+	recorder, err := newSMTPRecorder(t, "SMTPUTF8")
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}
+
+	to := []string{"Müller <müller@exämple.de>"}
+	cc := []string{"jürgen@exämple.de"}
+	if err := service.SendEmailFull("gopher@gopherpit.com", to, cc, nil, "test subject", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+	if to[0] != "Müller <müller@exämple.de>" {
+		t.Errorf("recipients modified to %q", to)
+	}
+
+	m := recorder.Message()
+	for _, want := range []string{
+		"To: =?UTF-8?q?M=C3=BCller?= <müller@xn--exmple-cua.de>\r\n",
+		"Cc: jürgen@xn--exmple-cua.de\r\n",
+	} {
+		if !bytes.Contains(m.Data, []byte(want)) {
+			t.Errorf("expected header %q in message %s", want, m.Data)
+		}
+	}
+	var rcpts []string
+	for _, c := range recorder.Commands() {
+		if strings.HasPrefix(c, "RCPT ") {
+			rcpts = append(rcpts, c)
+		}
+	}
+	want := []string{"RCPT TO:<müller@xn--exmple-cua.de>", "RCPT TO:<jürgen@xn--exmple-cua.de>"}
+	if !reflect.DeepEqual(rcpts, want) {
+		t.Errorf("got recipients %q, expected %q", rcpts, want)
+	}
+}
+
+func TestServiceHelloName(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+
+	for _, tc := range []struct {
+		name    string
+		service Service
+		want    string
+	}{
+		{
+			name:    "identity",
+			service: Service{SMTPIdentity: "mail.gopherpit.com", Hostname: "gopherpit.com"},
+			want:    "EHLO mail.gopherpit.com",
+		},
+		{
+			name:    "hostname",
+			service: Service{Hostname: "gopherpit.com"},
+			want:    "EHLO gopherpit.com",
+		},
+		{
+			name: "default",
+			want: "EHLO " + hostname,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder, err := newSMTPRecorder(t)
+			if err != nil {
+				t.Fatalf("smtp listen: %s", err)
+			}
+
+			service := tc.service
+			service.SMTPHost = "localhost"
+			service.SMTPPort = recorder.Port
+
+			if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+				t.Fatalf("send email: %s", err)
+			}
+			if got := recorder.Commands()[0]; got != tc.want {
+				t.Errorf("got %q, expected %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestServiceImplicitTLS(t *testing.T) {
+	recorder, err := newSMTPSRecorder(t, &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, -1)},
+	}, "AUTH PLAIN")
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	t.Run("skip verify", func(t *testing.T) {
+		service := Service{
+			SMTPHost:        "localhost",
+			SMTPPort:        recorder.Port,
+			SMTPImplicitTLS: true,
+			SMTPSkipVerify:  true,
+			SMTPUsername:    "gopher",
+			SMTPPassword:    "secret",
+		}
+
+		if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+			t.Fatalf("send email: %s", err)
+		}
+		if recorder.Message() == nil {
+			t.Fatal("expected message, but none has been recorded")
+		}
+		for _, c := range recorder.Commands() {
+			if c == "STARTTLS" {
+				t.Error("unexpected STARTTLS command over implicit TLS connection")
+			}
+		}
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		service := Service{
+			SMTPHost:        "localhost",
+			SMTPPort:        recorder.Port,
+			SMTPImplicitTLS: true,
+		}
+
+		err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+		var e *SendError
+		if !errors.As(err, &e) || e.Stage != StageDial {
+			t.Fatalf("expected SendError at stage %v, got %v", StageDial, err)
+		}
+		var certErr *tls.CertificateVerificationError
+		if !errors.As(err, &certErr) {
+			t.Errorf("expected certificate verification error, got %v", err)
+		}
+	})
+}
+
+func TestServiceSendTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// Reply only with the greeting and hang.
+			go func() {
+				defer conn.Close()
+				if _, err := conn.Write([]byte("220 Welcome\r\n")); err != nil {
+					return
+				}
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	service := Service{
+		SMTPHost:    "localhost",
+		SMTPPort:    l.Addr().(*net.TCPAddr).Port,
+		SendTimeout: 100 * time.Millisecond,
+	}
+
+	start := time.Now()
+	err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("send took %s, expected to time out after %s", d, service.SendTimeout)
+	}
+}
+
+func TestServiceOAuth2Auth(t *testing.T) {
+	t.Run("accepted", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t, "AUTH XOAUTH2 PLAIN")
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: recorder.Port,
+			SMTPAuth: OAuth2Auth("gopher@gopherpit.com", "ya29.token"),
+		}
+
+		if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+			t.Fatalf("send email: %s", err)
+		}
+
+		want := "AUTH XOAUTH2 " + base64.StdEncoding.EncodeToString([]byte("user=gopher@gopherpit.com\x01auth=Bearer ya29.token\x01\x01"))
+		var found bool
+		for _, c := range recorder.Commands() {
+			if c == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected command %q, got %q", want, recorder.Commands())
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t, "AUTH XOAUTH2")
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+		details := `{"status":"401","schemes":"bearer","scope":"https://mail.google.com/"}`
+		recorder.SetReply("AUTH", "334 "+base64.StdEncoding.EncodeToString([]byte(details)))
+
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: recorder.Port,
+			SMTPAuth: OAuth2Auth("gopher@gopherpit.com", "expired"),
+		}
+
+		err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+		var e *SendError
+		if !errors.As(err, &e) || e.Stage != StageAuth {
+			t.Fatalf("expected SendError at stage %v, got %v", StageAuth, err)
+		}
+		if !strings.Contains(err.Error(), details) {
+			t.Errorf("expected error with server details, got %q", err)
+		}
+		if commands := recorder.Commands(); commands[len(commands)-1] != "*" {
+			t.Errorf("expected aborted authentication, got commands %q", commands)
+		}
+	})
+}
+
+func TestServiceVerify(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t, "AUTH PLAIN")
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+
+		service := Service{
+			SMTPHost:     "localhost",
+			SMTPPort:     recorder.Port,
+			SMTPIdentity: "localhost",
+			SMTPUsername: "gopher",
+			SMTPPassword: "secret",
+		}
+
+		if err := service.Verify(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		commands := recorder.Commands()
+		if len(commands) != 3 || commands[0] != "EHLO localhost" || !strings.HasPrefix(commands[1], "AUTH PLAIN ") || commands[2] != "QUIT" {
+			t.Errorf("unexpected commands %q", commands)
+		}
+		if m := recorder.Message(); m != nil {
+			t.Errorf("unexpected message %#v", m)
+		}
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t, "AUTH PLAIN")
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+		recorder.SetReply("AUTH", "535 5.7.8 Authentication credentials invalid")
+
+		service := Service{
+			SMTPHost:     "localhost",
+			SMTPPort:     recorder.Port,
+			SMTPUsername: "gopher",
+			SMTPPassword: "wrong",
+		}
+
+		err = service.Verify(context.Background())
+		var e *SendError
+		if !errors.As(err, &e) || e.Stage != StageAuth {
+			t.Fatalf("expected SendError at stage %v, got %v", StageAuth, err)
+		}
+		if want := "localhost:" + strconv.Itoa(recorder.Port); e.Address != want {
+			t.Errorf("got address %q, expected %q", e.Address, want)
+		}
+	})
+}
+
+func TestServiceAuthMechanism(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		extensions []string
+		mechanism  AuthMechanism
+		want       string
+	}{
+		{
+			name:       "auto cram-md5",
+			extensions: []string{"AUTH LOGIN PLAIN CRAM-MD5"},
+			want:       "AUTH CRAM-MD5",
+		},
+		{
+			name:       "auto plain",
+			extensions: []string{"AUTH LOGIN PLAIN"},
+			want:       "AUTH PLAIN ",
+		},
+		{
+			name:       "auto login",
+			extensions: []string{"AUTH LOGIN"},
+			want:       "AUTH LOGIN",
+		},
+		{
+			name: "auto unsupported",
+		},
+		{
+			name:       "plain",
+			extensions: []string{"AUTH LOGIN PLAIN CRAM-MD5"},
+			mechanism:  AuthPlain,
+			want:       "AUTH PLAIN ",
+		},
+		{
+			name:       "login",
+			extensions: []string{"AUTH LOGIN PLAIN CRAM-MD5"},
+			mechanism:  AuthLogin,
+			want:       "AUTH LOGIN",
+		},
+		{
+			name:       "cram-md5",
+			extensions: []string{"AUTH PLAIN"},
+			mechanism:  AuthCRAMMD5,
+			want:       "AUTH CRAM-MD5",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder, err := newSMTPRecorder(t, tc.extensions...)
+			if err != nil {
+				t.Fatalf("smtp listen: %s", err)
+			}
+
+			service := Service{
+				SMTPHost:          "localhost",
+				SMTPPort:          recorder.Port,
+				SMTPUsername:      "gopher",
+				SMTPPassword:      "secret",
+				SMTPAuthMechanism: tc.mechanism,
+			}
+
+			if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+				t.Fatalf("send email: %s", err)
+			}
+
+			var got string
+			for _, c := range recorder.Commands() {
+				if strings.HasPrefix(c, "AUTH ") {
+					got = c
+				}
+			}
+			if !strings.HasPrefix(got, tc.want) || (tc.want == "") != (got == "") {
+				t.Errorf("got command %q, expected %q", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t, "AUTH PLAIN")
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+
+		service := Service{
+			SMTPHost:          "localhost",
+			SMTPPort:          recorder.Port,
+			SMTPUsername:      "gopher",
+			SMTPPassword:      "secret",
+			SMTPAuthMechanism: "DIGEST-MD5",
+		}
+
+		err = service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+		var e *SendError
+		if !errors.As(err, &e) || e.Stage != StageAuth {
+			t.Fatalf("expected SendError at stage %v, got %v", StageAuth, err)
+		}
+	})
+}
+
+func TestServicePipelining(t *testing.T) {
+	recorder, err := newSMTPRecorder(t, "PIPELINING")
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	pool := NewPool(Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+	}, 1)
+	defer pool.Close()
+
+	to := []string{"support@gopherpit.com", "sales@gopherpit.com", "ops@gopherpit.com"}
+
+	recorder.QueueReplies("RCPT", "250 Recipient", "550 5.1.1 User unknown", "550 5.1.1 User unknown")
+	err = pool.SendEmail("gopher@gopherpit.com", to, "test subject", "test body")
+	var e *SendError
+	if !errors.As(err, &e) || e.Stage != StageRcpt || e.Code != 550 {
+		t.Fatalf("expected SendError at stage %v with code 550, got %v", StageRcpt, err)
+	}
+
+	if err := pool.SendEmail("gopher@gopherpit.com", to, "test subject", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	want := []string{
+		"MAIL FROM:<gopher@gopherpit.com>",
+		"RCPT TO:<support@gopherpit.com>",
+		"RCPT TO:<sales@gopherpit.com>",
+		"RCPT TO:<ops@gopherpit.com>",
+		"RSET",
+		"MAIL FROM:<gopher@gopherpit.com>",
+		"RCPT TO:<support@gopherpit.com>",
+		"RCPT TO:<sales@gopherpit.com>",
+		"RCPT TO:<ops@gopherpit.com>",
+		"DATA",
+	}
+	commands := recorder.Commands()
+	if len(commands) < len(want)+1 || !reflect.DeepEqual(commands[1:len(want)+1], want) {
+		t.Errorf("got commands %q, expected %q after EHLO", commands, want)
+	}
+	if m := recorder.Message(); m == nil || len(m.To) != len(to) {
+		t.Errorf("unexpected message %#v", m)
+	}
+}
+
+func BenchmarkServicePipelining(b *testing.B) {
+	to := make([]string, 20)
+	for i := range to {
+		to[i] = fmt.Sprintf("gopher%d@gopherpit.com", i)
+	}
+	for _, extensions := range [][]string{nil, {"PIPELINING"}} {
+		b.Run(fmt.Sprintf("%q", extensions), func(b *testing.B) {
+			l, err := net.Listen("tcp", "")
+			if err != nil {
+				b.Fatalf("listen: %s", err)
+			}
+			recorder := listenSMTPRecorder(b, latencyListener{Listener: l, latency: time.Millisecond}, extensions...)
+
+			pool := NewPool(Service{
+				SMTPHost: "localhost",
+				SMTPPort: recorder.Port,
+			}, 1)
+			defer pool.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := pool.SendEmail("gopher@gopherpit.com", to, "test subject", "test body"); err != nil {
+					b.Fatalf("send email: %s", err)
+				}
+			}
+		})
+	}
+}
+
+// latencyListener accepts connections which deliver written data after the
+// latency, to simulate a distant server.
+type latencyListener struct {
+	net.Listener
+	latency time.Duration
+}
+
+func (l latencyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &latencyConn{
+		Conn:    conn,
+		latency: l.latency,
+		writes:  make(chan latencyWrite, 64),
+	}
+	go c.deliver()
+	return c, nil
+}
+
+type latencyConn struct {
+	net.Conn
+	latency time.Duration
+	writes  chan latencyWrite
+	once    sync.Once
+}
+
+type latencyWrite struct {
+	data []byte
+	at   time.Time
+}
+
+func (c *latencyConn) Write(p []byte) (int, error) {
+	c.writes <- latencyWrite{
+		data: append([]byte(nil), p...),
+		at:   time.Now().Add(c.latency),
+	}
+	return len(p), nil
+}
+
+// deliver writes the data in order, when its latency elapses, and closes the
+// connection when all data is written.
+func (c *latencyConn) deliver() {
+	defer c.Conn.Close()
+	for w := range c.writes {
+		time.Sleep(time.Until(w.at))
+		if _, err := c.Conn.Write(w.data); err != nil {
+			return
+		}
+	}
+}
+
+func (c *latencyConn) Close() error {
+	c.once.Do(func() {
+		close(c.writes)
+	})
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SendStats collects aggregate statistics of messages sent by Service. It is
+// safe for concurrent use and a single instance can be shared by multiple
+// services.
+type SendStats struct {
+	sent    atomic.Int64
+	failed  atomic.Int64
+	retried atomic.Int64
+	bytes   atomic.Int64
+	latency atomic.Int64
+}
+
+// Stats is a snapshot of send statistics.
+type Stats struct {
+	// Number of successfully sent messages.
+	Sent int64
+	// Number of messages that failed to be sent.
+	Failed int64
+	// Number of retried send attempts.
+	Retried int64
+	// Total size of successfully sent messages in bytes.
+	Bytes int64
+	// Average duration of both successful and failed send attempts.
+	AverageLatency time.Duration
+}
+
+// Snapshot returns the current statistics. Values are read independently, so
+// the snapshot may not be consistent while messages are being sent.
+func (s *SendStats) Snapshot() Stats {
+	stats := Stats{
+		Sent:    s.sent.Load(),
+		Failed:  s.failed.Load(),
+		Retried: s.retried.Load(),
+		Bytes:   s.bytes.Load(),
+	}
+	if n := stats.Sent + stats.Failed; n > 0 {
+		stats.AverageLatency = time.Duration(s.latency.Load() / n)
+	}
+	return stats
+}
+
+// record adds a single send attempt to statistics.
+func (s *SendStats) record(bytes int64, latency time.Duration, err error) {
+	s.latency.Add(int64(latency))
+	if err != nil {
+		s.failed.Add(1)
+		return
+	}
+	s.sent.Add(1)
+	s.bytes.Add(bytes)
+}
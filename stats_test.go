@@ -0,0 +1,79 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendStatsConcurrent(t *testing.T) {
+	stats := new(SendStats)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				var err error
+				if j%4 == 0 {
+					err = errors.New("test error")
+				}
+				stats.record(10, time.Millisecond, err)
+				_ = stats.Snapshot()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	want := Stats{
+		Sent:           3750,
+		Failed:         1250,
+		Bytes:          37500,
+		AverageLatency: time.Millisecond,
+	}
+	if got := stats.Snapshot(); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestServiceStats(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost: "localhost",
+		SMTPPort: recorder.Port,
+		Stats:    new(SendStats),
+	}
+
+	if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+	recorder.SetReply("RCPT", "550 5.1.1 Unknown user")
+	if err := service.SendEmail("gopher@gopherpit.com", []string{"unknown@gopherpit.com"}, "test subject", "test body"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	stats := service.Stats.Snapshot()
+	if stats.Sent != 1 {
+		t.Errorf("expected 1 sent message, got %v", stats.Sent)
+	}
+	if stats.Failed != 1 {
+		t.Errorf("expected 1 failed message, got %v", stats.Failed)
+	}
+	if stats.Bytes <= int64(len("test body")) {
+		t.Errorf("expected bytes to include the message, got %v", stats.Bytes)
+	}
+	if stats.AverageLatency <= 0 {
+		t.Errorf("expected positive average latency, got %v", stats.AverageLatency)
+	}
+}
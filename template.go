@@ -0,0 +1,137 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"sync"
+	texttemplate "text/template"
+)
+
+var (
+	// ErrTemplateNotFound is returned by Service.SendTemplate if the template
+	// with the provided name is not registered.
+	ErrTemplateNotFound = errors.New("email: template not found")
+	// ErrEmptyTemplate is returned by Template.Register if neither plain text
+	// nor HTML template is provided.
+	ErrEmptyTemplate = errors.New("email: empty template")
+)
+
+// Template holds named templates for message bodies. Plain text bodies are
+// rendered with text/template and HTML bodies with html/template. It is safe
+// for concurrent use.
+type Template struct {
+	mu        sync.RWMutex
+	templates map[string]bodyTemplate
+}
+
+type bodyTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// NewTemplate returns a new empty Template.
+func NewTemplate() *Template {
+	return &Template{
+		templates: make(map[string]bodyTemplate),
+	}
+}
+
+// Register parses plain text and HTML templates and registers them under the
+// name, replacing any previously registered templates with the same name.
+// Either of text or html may be empty, but not both.
+func (t *Template) Register(name, text, html string) error {
+	if text == "" && html == "" {
+		return ErrEmptyTemplate
+	}
+	var b bodyTemplate
+	if text != "" {
+		tpl, err := texttemplate.New(name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return fmt.Errorf("email: parse text template %q: %w", name, err)
+		}
+		b.text = tpl
+	}
+	if html != "" {
+		tpl, err := htmltemplate.New(name).Option("missingkey=error").Parse(html)
+		if err != nil {
+			return fmt.Errorf("email: parse html template %q: %w", name, err)
+		}
+		b.html = tpl
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.templates == nil {
+		t.templates = make(map[string]bodyTemplate)
+	}
+	t.templates[name] = b
+	return nil
+}
+
+// render executes the subject template and the registered body templates
+// with the data.
+func (t *Template) render(name, subject string, data interface{}) (s, text, html string, err error) {
+	var b bodyTemplate
+	var ok bool
+	if t != nil {
+		t.mu.RLock()
+		b, ok = t.templates[name]
+		t.mu.RUnlock()
+	}
+	if !ok {
+		return "", "", "", fmt.Errorf("%w: %q", ErrTemplateNotFound, name)
+	}
+
+	tpl, err := texttemplate.New("subject").Option("missingkey=error").Parse(subject)
+	if err != nil {
+		return "", "", "", fmt.Errorf("email: parse subject template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", "", "", fmt.Errorf("email: render subject: %w", err)
+	}
+	s = buf.String()
+
+	if b.text != nil {
+		buf.Reset()
+		if err := b.text.Execute(&buf, data); err != nil {
+			return "", "", "", fmt.Errorf("email: render text template %q: %w", name, err)
+		}
+		text = buf.String()
+	}
+	if b.html != nil {
+		buf.Reset()
+		if err := b.html.Execute(&buf, data); err != nil {
+			return "", "", "", fmt.Errorf("email: render html template %q: %w", name, err)
+		}
+		html = buf.String()
+	}
+	return s, text, html, nil
+}
+
+// SendTemplate sends an email message with the body rendered from the
+// template registered in Service.Template under the templateName. The subject
+// is also a text/template rendered with the same data. If the template has
+// both plain text and HTML bodies, they are sent as multipart/alternative, and
+// if it has only the HTML body, the plain text part is generated with
+// HTMLToText. Rendering errors are returned before the message is sent.
+func (s Service) SendTemplate(from string, to []string, subject string, templateName string, data interface{}) error {
+	subject, text, html, err := s.Template.render(templateName, subject, data)
+	if err != nil {
+		return err
+	}
+	switch {
+	case html == "":
+		return s.SendEmail(from, to, subject, text)
+	case text == "":
+		return s.SendHTMLEmail(from, to, subject, html)
+	}
+	return s.SendAlternative(from, to, subject, text, html)
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestServiceSendTemplate(t *testing.T) {
+	tpl := NewTemplate()
+	if err := tpl.Register("welcome", "Hello, {{.Name}}!\r\n", "<p>Hello, <b>{{.Name}}</b>!</p>"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tpl.Register("html", "", "<p>{{.Name}}</p>"); err != nil {
+		t.Fatal(err)
+	}
+
+	data := struct{ Name string }{Name: "<gopher>"}
+
+	t.Run("alternative", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: recorder.Port,
+			Template: tpl,
+		}
+
+		if err := service.SendTemplate("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "Welcome, {{.Name}}", "welcome", data); err != nil {
+			t.Fatal(err)
+		}
+
+		m := recorder.Message()
+		if got, want := m.Header.Get("Subject"), "Welcome, <gopher>"; got != want {
+			t.Errorf("got subject %q, expected %q", got, want)
+		}
+		checkAlternativeParts(t, m, "Hello, <gopher>!\r\n", "<p>Hello, <b>&lt;gopher&gt;</b>!</p>")
+	})
+
+	t.Run("html only", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: recorder.Port,
+			Template: tpl,
+		}
+
+		if err := service.SendTemplate("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test", "html", data); err != nil {
+			t.Fatal(err)
+		}
+
+		html := "<p>&lt;gopher&gt;</p>"
+		checkAlternativeParts(t, recorder.Message(), HTMLToText(html), html)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		recorder, err := newSMTPRecorder(t)
+		if err != nil {
+			t.Fatalf("smtp listen: %s", err)
+		}
+		service := Service{
+			SMTPHost: "localhost",
+			SMTPPort: recorder.Port,
+			Template: tpl,
+		}
+
+		err = service.SendTemplate("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test", "missing", data)
+		if !errors.Is(err, ErrTemplateNotFound) {
+			t.Errorf("expected error %v, got %v", ErrTemplateNotFound, err)
+		}
+		if err := service.SendTemplate("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "{{.Missing}}", "welcome", data); err == nil {
+			t.Error("expected subject render error")
+		}
+		if err := service.SendTemplate("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test", "welcome", map[string]string{}); err == nil {
+			t.Error("expected body render error")
+		}
+		if commands := recorder.Commands(); len(commands) != 0 {
+			t.Errorf("expected no smtp commands, got %q", commands)
+		}
+	})
+}
+
+func TestTemplateRegister(t *testing.T) {
+	tpl := NewTemplate()
+	if err := tpl.Register("empty", "", ""); !errors.Is(err, ErrEmptyTemplate) {
+		t.Errorf("expected error %v, got %v", ErrEmptyTemplate, err)
+	}
+	if err := tpl.Register("invalid", "{{.Name", ""); err == nil {
+		t.Error("expected parse error")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// ErrInvalidThreadIndex is returned by ThreadIndex when the provided times
+// can not be encoded.
+var ErrInvalidThreadIndex = errors.New("email: invalid thread index")
+
+// FILETIME epoch is 1601-01-01 UTC and its unit is 100 nanoseconds.
+const fileTimeUnixOffset = 116444736000000000
+
+// ThreadIndex returns the value for Thread-Index header that Microsoft
+// Outlook uses to thread messages of a conversation instead of References
+// header. It should be set together with Thread-Topic header that contains
+// the conversation subject without prefixes like "Re:".
+//
+// The conversation is identified by the time when it started and a GUID,
+// which are encoded in the 22 bytes long header block: six most significant
+// bytes of the FILETIME value of the root time and 16 bytes of the GUID. For
+// every reply in the chain from the root message to the current one, a five
+// bytes long child block is appended. It contains a 31 bits long time
+// difference from the root time and a byte with four bits derived from the
+// GUID in place of random bits and four bits of the child block sequence
+// number. The result is base64 encoded.
+//
+// ThreadIndex returns the same value for the same arguments. Replies must
+// not be before the root time.
+func ThreadIndex(root time.Time, guid [16]byte, replies ...time.Time) (string, error) {
+	if root.Before(time.Unix(0, 0)) {
+		return "", ErrInvalidThreadIndex
+	}
+
+	b := make([]byte, 22, 22+5*len(replies))
+	rootTime := fileTime(root) >> 16 << 16
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], rootTime)
+	copy(b[:6], t[:6])
+	copy(b[6:], guid[:])
+
+	for i, r := range replies {
+		if r.Before(root) {
+			return "", ErrInvalidThreadIndex
+		}
+		delta := fileTime(r) - rootTime
+		var d uint32
+		if delta&0xfffe000000000000 == 0 {
+			d = uint32(delta>>18) & 0x7fffffff
+		} else {
+			d = uint32(delta>>23)&0x7fffffff | 0x80000000
+		}
+		var c [5]byte
+		binary.BigEndian.PutUint32(c[:4], d)
+		c[4] = guid[i%len(guid)]&0xf0 | byte(i)&0x0f
+		b = append(b, c[:]...)
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func fileTime(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100) + fileTimeUnixOffset
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestThreadIndex(t *testing.T) {
+	root := time.Date(2016, 10, 16, 12, 0, 0, 0, time.UTC)
+	guid := [16]byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c}
+
+	for _, tc := range []struct {
+		name    string
+		replies []time.Time
+		want    string
+	}{
+		{
+			name: "root",
+			want: "AdInpNIW3q2+7wECAwQFBgcICQoLDA==",
+		},
+		{
+			name:    "replies",
+			replies: []time.Time{root.Add(time.Hour), root.Add(25 * time.Hour)},
+			want:    "AdInpNIW3q2+7wECAwQFBgcICQoLDAACGHHQADRjC6E=",
+		},
+		{
+			name:    "distant reply",
+			replies: []time.Time{root.AddDate(3, 0, 0)},
+			want:    "AdInpNIW3q2+7wECAwQFBgcICQoLDIa46NTQ",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ThreadIndex(root, guid, tc.replies...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+
+			b, err := base64.StdEncoding.DecodeString(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) != 22+5*len(tc.replies) {
+				t.Errorf("expected length %v, got %v", 22+5*len(tc.replies), len(b))
+			}
+			if b[0] != 0x01 {
+				t.Errorf("expected first byte 0x01, got %#x", b[0])
+			}
+			if !bytes.Equal(b[6:22], guid[:]) {
+				t.Errorf("expected guid %x, got %x", guid, b[6:22])
+			}
+		})
+	}
+}
+
+func TestThreadIndexInvalid(t *testing.T) {
+	root := time.Date(2016, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	if _, err := ThreadIndex(root, [16]byte{}, root.Add(-time.Second)); err != ErrInvalidThreadIndex {
+		t.Errorf("reply before root: expected error %v, got %v", ErrInvalidThreadIndex, err)
+	}
+	if _, err := ThreadIndex(time.Time{}, [16]byte{}); err != ErrInvalidThreadIndex {
+		t.Errorf("zero root: expected error %v, got %v", ErrInvalidThreadIndex, err)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"context"
+	"sync"
+)
+
+// Transport delivers a complete RFC 5322 message to recipients. It allows
+// Service to send messages with other backends than SMTP, or to record them
+// in tests.
+type Transport interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+var (
+	_ Transport = smtpTransport{}
+	_ Transport = new(MemoryTransport)
+)
+
+// NewSMTPTransport returns a Transport that delivers messages over SMTP,
+// including fallback servers, or with the sendmail program, as configured by
+// the service. It can be used to wrap the default delivery in another
+// Transport.
+func NewSMTPTransport(s Service) Transport {
+	s.Transport = nil
+	return smtpTransport{service: s}
+}
+
+type smtpTransport struct {
+	service Service
+}
+
+func (t smtpTransport) Send(from string, to []string, msg []byte) error {
+	_, err := t.service.sender()(context.Background(), from, to, messageData(msg), sendOptions{})
+	return err
+}
+
+// MemoryTransport is a Transport that keeps all messages in memory. It is
+// intended to be used in tests.
+type MemoryTransport struct {
+	messages []TransportMessage
+	mu       sync.Mutex
+}
+
+// TransportMessage is a message recorded by MemoryTransport.
+type TransportMessage struct {
+	// Envelope sender address.
+	From string
+	// Envelope recipient addresses.
+	To []string
+	// Complete message.
+	Data []byte
+}
+
+// Send records the message.
+func (t *MemoryTransport) Send(from string, to []string, msg []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = append(t.messages, TransportMessage{
+		From: from,
+		To:   append([]string(nil), to...),
+		Data: append([]byte(nil), msg...),
+	})
+	return nil
+}
+
+// Messages returns all recorded messages in the order they were sent.
+func (t *MemoryTransport) Messages() []TransportMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TransportMessage(nil), t.messages...)
+}
+
+// Reset removes all recorded messages.
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestServiceTransport(t *testing.T) {
+	transport := new(MemoryTransport)
+	service := Service{
+		Transport: transport,
+	}
+
+	if err := service.SendEmailFull("gopher@gopherpit.com", []string{"support@gopherpit.com"}, nil, []string{"archive@gopherpit.com"}, "test subject", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	messages := transport.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("got %v messages, expected 1", len(messages))
+	}
+	m := messages[0]
+	if m.From != "gopher@gopherpit.com" {
+		t.Errorf("got envelope sender %q", m.From)
+	}
+	if want := []string{"support@gopherpit.com", "archive@gopherpit.com"}; !reflect.DeepEqual(m.To, want) {
+		t.Errorf("got recipients %q, expected %q", m.To, want)
+	}
+	if got := parseSMTPMessage(t, m.Data); got.Subject != "test subject" || got.Body != "test body" {
+		t.Errorf("got message %+v", got)
+	}
+
+	transport.Reset()
+	if messages := transport.Messages(); len(messages) != 0 {
+		t.Errorf("got %v messages after reset, expected none", len(messages))
+	}
+}
+
+type errorTransport struct {
+	err error
+}
+
+func (t errorTransport) Send(string, []string, []byte) error {
+	return t.err
+}
+
+func TestServiceTransportError(t *testing.T) {
+	errTest := errors.New("test error")
+	service := Service{
+		Transport: errorTransport{err: errTest},
+	}
+
+	err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+	var e *SendError
+	if !errors.Is(err, errTest) || !errors.As(err, &e) {
+		t.Errorf("expected SendError with error %v, got %v", errTest, err)
+	}
+	if want := "email: " + errTest.Error(); err.Error() != want {
+		t.Errorf("got error message %q, expected %q", err, want)
+	}
+}
+
+func TestNewSMTPTransport(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	transport := NewSMTPTransport(Service{
+		SMTPHost:  "localhost",
+		SMTPPort:  recorder.Port,
+		Transport: new(MemoryTransport),
+	})
+
+	data := []byte("From: gopher@gopherpit.com\r\nTo: support@gopherpit.com\r\nSubject: test\r\n\r\ntest body\r\n")
+	if err := transport.Send("gopher@gopherpit.com", []string{"support@gopherpit.com"}, data); err != nil {
+		t.Fatalf("send: %s", err)
+	}
+	m := recorder.Message()
+	if m == nil {
+		t.Fatal("expected message, but none has been recorded")
+	}
+	if string(m.Data) != string(data) {
+		t.Errorf("got message %q, expected %q", m.Data, data)
+	}
+}
+
+func TestNewSMTPTransportFallbackServers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	closedPort := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	fallback, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	transport := NewSMTPTransport(Service{
+		SMTPHost: "127.0.0.1",
+		SMTPPort: closedPort,
+		SMTPFallbackServers: []SMTPServer{
+			{Host: "localhost", Port: fallback.Port},
+		},
+	})
+
+	data := []byte("From: gopher@gopherpit.com\r\nTo: support@gopherpit.com\r\nSubject: test\r\n\r\ntest body\r\n")
+	if err := transport.Send("gopher@gopherpit.com", []string{"support@gopherpit.com"}, data); err != nil {
+		t.Fatalf("send: %s", err)
+	}
+	if m := fallback.Message(); m == nil || m.Subject != "test" {
+		t.Errorf("expected message to be sent to the fallback server, got %#v", m)
+	}
+}
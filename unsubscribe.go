@@ -0,0 +1,57 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import "strings"
+
+// ListUnsubscribe describes how recipients of a mailing list message can
+// unsubscribe, with List-Unsubscribe header, as defined in RFC 2369, and
+// one-click unsubscription, as defined in RFC 8058.
+type ListUnsubscribe struct {
+	// HTTPS URL that unsubscribes the recipient. It should identify the
+	// recipient and the list, as no other information is sent with
+	// one-click requests.
+	URL string
+	// Email address, or mailto URL, that unsubscribe requests are sent to.
+	Mailto string
+	// If true, List-Unsubscribe-Post header is set so that mail clients
+	// unsubscribe the recipient with a POST request to the URL, without
+	// user interaction with the web page. It requires URL to be set.
+	OneClick bool
+}
+
+// Headers returns List-Unsubscribe header, and List-Unsubscribe-Post header
+// for one-click unsubscription. It returns nil if neither URL nor Mailto is
+// set. The result can be passed to methods with headers argument, for
+// example:
+//
+//	service.SendEmailWithHeaders(from, to, subject, body, email.ListUnsubscribe{
+//		URL:      "https://example.com/unsubscribe/opaque-token",
+//		OneClick: true,
+//	}.Headers())
+func (u ListUnsubscribe) Headers() map[string][]string {
+	var uris []string
+	if u.Mailto != "" {
+		mailto := u.Mailto
+		if !strings.HasPrefix(strings.ToLower(mailto), "mailto:") {
+			mailto = "mailto:" + mailto
+		}
+		uris = append(uris, "<"+mailto+">")
+	}
+	if u.URL != "" {
+		uris = append(uris, "<"+u.URL+">")
+	}
+	if len(uris) == 0 {
+		return nil
+	}
+	h := map[string][]string{
+		"List-Unsubscribe": {strings.Join(uris, ", ")},
+	}
+	if u.OneClick && u.URL != "" {
+		h["List-Unsubscribe-Post"] = []string{"List-Unsubscribe=One-Click"}
+	}
+	return h
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestListUnsubscribeHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		u    ListUnsubscribe
+		want map[string][]string
+	}{
+		{
+			name: "empty",
+			u:    ListUnsubscribe{OneClick: true},
+			want: nil,
+		},
+		{
+			name: "url",
+			u:    ListUnsubscribe{URL: "https://gopherpit.com/unsubscribe/1234"},
+			want: map[string][]string{
+				"List-Unsubscribe": {"<https://gopherpit.com/unsubscribe/1234>"},
+			},
+		},
+		{
+			name: "mailto",
+			u:    ListUnsubscribe{Mailto: "unsubscribe@gopherpit.com", OneClick: true},
+			want: map[string][]string{
+				"List-Unsubscribe": {"<mailto:unsubscribe@gopherpit.com>"},
+			},
+		},
+		{
+			name: "one-click",
+			u: ListUnsubscribe{
+				URL:      "https://gopherpit.com/unsubscribe/1234",
+				Mailto:   "mailto:unsubscribe@gopherpit.com?subject=unsubscribe",
+				OneClick: true,
+			},
+			want: map[string][]string{
+				"List-Unsubscribe":      {"<mailto:unsubscribe@gopherpit.com?subject=unsubscribe>, <https://gopherpit.com/unsubscribe/1234>"},
+				"List-Unsubscribe-Post": {"List-Unsubscribe=One-Click"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.u.Headers(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, expected %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestServiceSendListUnsubscribe(t *testing.T) {
+	transport := new(MemoryTransport)
+	service := Service{
+		Transport: transport,
+	}
+
+	u := ListUnsubscribe{
+		URL:      "https://gopherpit.com/unsubscribe/1234",
+		Mailto:   "unsubscribe@gopherpit.com",
+		OneClick: true,
+	}
+	if err := service.Send(&Message{
+		From:            "gopher@gopherpit.com",
+		To:              []string{"support@gopherpit.com"},
+		Subject:         "test subject",
+		TextBody:        "test body",
+		ListUnsubscribe: u,
+	}); err != nil {
+		t.Fatalf("send: %s", err)
+	}
+	if err := service.SendEmailWithHeaders("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body", u.Headers()); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+
+	for _, msg := range transport.Messages() {
+		m := parseSMTPMessage(t, msg.Data)
+		for field, want := range u.Headers() {
+			if got := m.Header.Get(field); got != want[0] {
+				t.Errorf("header %s: got %q, expected %q", field, got, want[0])
+			}
+		}
+	}
+}
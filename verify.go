@@ -0,0 +1,157 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"strings"
+
+	"gopkg.in/mail.v2"
+)
+
+// ErrMessageVerification is returned when a message is not sent because its
+// serialized form does not match the message that was built, if
+// Service.VerifyMessages is set.
+var ErrMessageVerification = errors.New("email: message verification failed")
+
+// messageBody holds the plain text and HTML bodies of a message as they are
+// set in its parts.
+type messageBody struct {
+	text string
+	html string
+}
+
+// verifyMessage parses the serialized message data and checks that its
+// address and subject headers are the same as in the message, that its body
+// can be decoded, and that its first text/plain and text/html parts, which are
+// not attachments, are the same as the non-empty bodies.
+func verifyMessage(m *mail.Message, data []byte, body messageBody) error {
+	msg, err := netmail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMessageVerification, err)
+	}
+	for _, field := range []string{"From", "Sender", "Reply-To", "To", "Cc"} {
+		want, err := addressList(m.GetHeader(field))
+		if err != nil {
+			return fmt.Errorf("%w: header %s: %v", ErrMessageVerification, field, err)
+		}
+		var got []string
+		if v := msg.Header.Get(field); v != "" {
+			got, err = addressList([]string{v})
+			if err != nil {
+				return fmt.Errorf("%w: header %s: %v", ErrMessageVerification, field, err)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			return fmt.Errorf("%w: header %s: expected %q, got %q", ErrMessageVerification, field, want, got)
+		}
+	}
+	var want string
+	if v := m.GetHeader("Subject"); len(v) > 0 {
+		want = v[0]
+	}
+	dec := new(mime.WordDecoder)
+	want, err = dec.DecodeHeader(want)
+	if err != nil {
+		return fmt.Errorf("%w: header Subject: %v", ErrMessageVerification, err)
+	}
+	got, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		return fmt.Errorf("%w: header Subject: %v", ErrMessageVerification, err)
+	}
+	if got != want {
+		return fmt.Errorf("%w: header Subject: expected %q, got %q", ErrMessageVerification, want, got)
+	}
+	parts := make(map[string]string)
+	if err := verifyBody(msg.Header, msg.Body, parts); err != nil {
+		return fmt.Errorf("%w: body: %v", ErrMessageVerification, err)
+	}
+	for _, p := range []struct {
+		mediaType string
+		want      string
+	}{
+		{mediaType: "text/plain", want: body.text},
+		{mediaType: "text/html", want: body.html},
+	} {
+		if p.want == "" {
+			continue
+		}
+		// Line breaks are written as CRLF by quoted-printable encoding.
+		if crlf.Replace(parts[p.mediaType]) != crlf.Replace(p.want) {
+			return fmt.Errorf("%w: body: %s part differs", ErrMessageVerification, p.mediaType)
+		}
+	}
+	return nil
+}
+
+var crlf = strings.NewReplacer("\r\n", "\n")
+
+// addressList returns email addresses from header values, without display
+// names.
+func addressList(values []string) (addresses []string, err error) {
+	for _, v := range values {
+		list, err := netmail.ParseAddressList(v)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range list {
+			addresses = append(addresses, a.Address)
+		}
+	}
+	return addresses, nil
+}
+
+// verifyBody checks that the body of the message or a multipart part can be
+// decoded, including all nested parts. Decoded content of the first part of
+// every text media type that is not an attachment is stored in parts.
+func verifyBody(header interface{ Get(string) string }, body io.Reader, parts map[string]string) error {
+	var mediaType string
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		var params map[string]string
+		var err error
+		mediaType, params, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(mediaType, "multipart/") {
+			r := multipart.NewReader(body, params["boundary"])
+			for {
+				p, err := r.NextRawPart()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err := verifyBody(p.Header, p, parts); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	var content strings.Builder
+	if _, err := io.Copy(&content, body); err != nil {
+		return err
+	}
+	if _, ok := parts[mediaType]; !ok && strings.HasPrefix(mediaType, "text/") && !strings.HasPrefix(header.Get("Content-Disposition"), "attachment") {
+		parts[mediaType] = content.String()
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"gopkg.in/mail.v2"
+)
+
+func TestVerifyMessage(t *testing.T) {
+	newMessage := func() *mail.Message {
+		m := mail.NewMessage()
+		m.SetAddressHeader("From", "gopher@gopherpit.com", "Гофер")
+		m.SetHeader("To", "support@gopherpit.com", "Operations <operations@gopherpit.com>")
+		m.SetHeader("Subject", "Grüße "+strings.Repeat("from the gopher ", 10))
+		m.SetBody("text/plain", "Grüße", mail.SetPartEncoding(mail.Base64))
+		return m
+	}
+
+	for _, tc := range []struct {
+		name    string
+		corrupt func(string) string
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			corrupt: func(s string) string { return s },
+		},
+		{
+			name: "subject",
+			corrupt: func(s string) string {
+				return strings.Replace(s, "Subject: =?UTF-8?q?Gr=C3=BC=C3=9Fe", "Subject: =?UTF-8?q?Gr=C3=BC=C3=9F", 1)
+			},
+			wantErr: true,
+		},
+		{
+			name: "recipient",
+			corrupt: func(s string) string {
+				return strings.Replace(s, "support@gopherpit.com", "supprot@gopherpit.com", 1)
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing header",
+			corrupt: func(s string) string {
+				return strings.Replace(s, "From:", "X-From:", 1)
+			},
+			wantErr: true,
+		},
+		{
+			name: "body encoding",
+			corrupt: func(s string) string {
+				return strings.Replace(s, "R3LDvMOfZQ==", "R3LDvMOf*Q==", 1)
+			},
+			wantErr: true,
+		},
+		{
+			name: "body content",
+			corrupt: func(s string) string {
+				return strings.Replace(s, "R3LDvMOfZQ==", "R3LDvMOfRQ==", 1)
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMessage()
+			var buf bytes.Buffer
+			if _, err := m.WriteTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			data := tc.corrupt(buf.String())
+			if !tc.wantErr && data != buf.String() {
+				t.Fatal("message data changed")
+			}
+			if tc.wantErr && data == buf.String() {
+				t.Fatal("message data not corrupted")
+			}
+
+			err := verifyMessage(m, []byte(data), messageBody{text: "Grüße"})
+			if tc.wantErr {
+				if !errors.Is(err, ErrMessageVerification) {
+					t.Errorf("expected error %v, got %v", ErrMessageVerification, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("verify message: %s", err)
+			}
+		})
+	}
+}
+
+func TestServiceVerifyMessages(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	service := Service{
+		SMTPHost:        "localhost",
+		SMTPPort:        recorder.Port,
+		DefaultFromName: "Гофер",
+		VerifyMessages:  true,
+	}
+
+	if err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "Grüße", "test body"); err != nil {
+		t.Fatalf("send email: %s", err)
+	}
+	if want := "test body\r\n"; recorder.Message().Body != want {
+		t.Errorf(`message body: expected "%v", got "%v"`, want, recorder.Message().Body)
+	}
+
+	if err := service.Send(&Message{
+		From:     "gopher@gopherpit.com",
+		To:       []string{"support@gopherpit.com"},
+		Subject:  "Grüße",
+		TextBody: "Grüße\n" + strings.Repeat("from the gopher ", 10) + "\n",
+		HTMLBody: "<p>Grüße</p>",
+		Attachments: []Attachment{
+			{Filename: "notes.txt", ContentType: "text/plain", Data: []byte("notes")},
+		},
+	}); err != nil {
+		t.Fatalf("send: %s", err)
+	}
+
+	if err := service.SendDigest("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "digest", [][]byte{
+		[]byte("Subject: first\r\n\r\nfirst body\r\n"),
+		[]byte("Subject: second\r\n\r\nsecond body\r\n"),
+	}); err != nil {
+		t.Fatalf("send digest: %s", err)
+	}
+}
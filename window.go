@@ -0,0 +1,70 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrOutsideSendWindow is returned when a message is not sent because the
+// current time is outside of Service.SendWindow.
+var ErrOutsideSendWindow = errors.New("email: outside of send window")
+
+// SendWindow defines hours of a day when messages are sent.
+type SendWindow struct {
+	// Hour when the window opens, from 0 to 23.
+	Start int
+	// Hour when the window closes, from 1 to 24. If it is less than Start,
+	// the window spans over midnight, and if it is equal to Start, the window
+	// is open for the whole day.
+	End int
+	// Time zone in which Start and End hours are defined. UTC is used if it
+	// is nil.
+	Location *time.Location
+	// If true, sending outside of the window waits until the window opens,
+	// instead of returning ErrOutsideSendWindow.
+	Wait bool
+}
+
+// until returns the duration from t until the window opens, or zero if the
+// window is open at t.
+func (w SendWindow) until(t time.Time) time.Duration {
+	loc := w.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	h := t.Hour()
+	if w.Start < w.End && h >= w.Start && h < w.End ||
+		w.Start >= w.End && (h >= w.Start || h < w.End) {
+		return 0
+	}
+	open := time.Date(t.Year(), t.Month(), t.Day(), w.Start, 0, 0, 0, loc)
+	if !open.After(t) {
+		open = open.AddDate(0, 0, 1)
+	}
+	return open.Sub(t)
+}
+
+// waitSendWindow returns ErrOutsideSendWindow, or waits if it is configured
+// so, if the current time is outside of the send window. Waiting stops when
+// the context is done.
+func (s Service) waitSendWindow(ctx context.Context) error {
+	if s.SendWindow == nil {
+		return nil
+	}
+	d := s.SendWindow.until(s.now())
+	if d == 0 {
+		return nil
+	}
+	if !s.SendWindow.Wait {
+		s.noOp(OutsideWindow)
+		return ErrOutsideSendWindow
+	}
+	return sleep(ctx, d)
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2016, Janoš Guljaš <janos@resenje.org>
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSendWindowUntil(t *testing.T) {
+	belgrade, err := time.LoadLocation("Europe/Belgrade")
+	if err != nil {
+		t.Skipf("load location: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		window SendWindow
+		time   time.Time
+		want   time.Duration
+	}{
+		{
+			name:   "in window",
+			window: SendWindow{Start: 8, End: 20},
+			time:   time.Date(2016, 10, 16, 12, 30, 0, 0, time.UTC),
+			want:   0,
+		},
+		{
+			name:   "before window",
+			window: SendWindow{Start: 8, End: 20},
+			time:   time.Date(2016, 10, 16, 6, 30, 0, 0, time.UTC),
+			want:   90 * time.Minute,
+		},
+		{
+			name:   "after window",
+			window: SendWindow{Start: 8, End: 20},
+			time:   time.Date(2016, 10, 16, 20, 0, 0, 0, time.UTC),
+			want:   12 * time.Hour,
+		},
+		{
+			name:   "over midnight in window",
+			window: SendWindow{Start: 22, End: 2},
+			time:   time.Date(2016, 10, 16, 1, 0, 0, 0, time.UTC),
+			want:   0,
+		},
+		{
+			name:   "over midnight outside window",
+			window: SendWindow{Start: 22, End: 2},
+			time:   time.Date(2016, 10, 16, 2, 0, 0, 0, time.UTC),
+			want:   20 * time.Hour,
+		},
+		{
+			name:   "whole day",
+			window: SendWindow{Start: 0, End: 0},
+			time:   time.Date(2016, 10, 16, 3, 0, 0, 0, time.UTC),
+			want:   0,
+		},
+		{
+			name:   "location",
+			window: SendWindow{Start: 8, End: 20, Location: belgrade},
+			time:   time.Date(2016, 10, 16, 6, 30, 0, 0, time.UTC),
+			want:   0,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.window.until(tc.time); got != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestServiceSendWindow(t *testing.T) {
+	recorder, err := newSMTPRecorder(t)
+	if err != nil {
+		t.Fatalf("smtp listen: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		time    time.Time
+		wantErr error
+	}{
+		{
+			name: "in window",
+			time: time.Date(2016, 10, 16, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "outside window",
+			time:    time.Date(2016, 10, 16, 23, 0, 0, 0, time.UTC),
+			wantErr: ErrOutsideSendWindow,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder.SetMessage(nil)
+
+			service := Service{
+				SMTPHost:   "localhost",
+				SMTPPort:   recorder.Port,
+				SendWindow: &SendWindow{Start: 8, End: 20},
+				Now: func() time.Time {
+					return tc.time
+				},
+			}
+
+			err := service.SendEmail("gopher@gopherpit.com", []string{"support@gopherpit.com"}, "test subject", "test body")
+			if err != tc.wantErr {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if sent := recorder.Message() != nil; sent != (tc.wantErr == nil) {
+				t.Errorf("expected message sent %v, got %v", tc.wantErr == nil, sent)
+			}
+		})
+	}
+}
+
+func TestServiceSendWindowWaitEnvelopeFromNotAllowed(t *testing.T) {
+	service := Service{
+		SMTPHost:            "localhost",
+		SMTPPort:            25,
+		SendWindow:          &SendWindow{Start: 8, End: 20, Wait: true},
+		AllowedEnvelopeFrom: []string{"bounces@gopherpit.com"},
+		Now: func() time.Time {
+			return time.Date(2016, 10, 16, 23, 0, 0, 0, time.UTC)
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := service.SendRawWithEnvelope(ctx, "gopher@gopherpit.com", []string{"support@gopherpit.com"}, []byte("Subject: test subject\r\n\r\ntest body\r\n"))
+	if !errors.Is(err, ErrEnvelopeFromNotAllowed) {
+		t.Fatalf("expected error %v, got %v", ErrEnvelopeFromNotAllowed, err)
+	}
+}